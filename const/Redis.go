@@ -0,0 +1,8 @@
+package Const
+
+import "errors"
+
+var (
+	// ErrRedis_NotConnected ...
+	ErrRedis_NotConnected = errors.New("Redis: client is not connected")
+)
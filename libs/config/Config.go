@@ -0,0 +1,553 @@
+package Config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	ETCD "iparking/share/libs/etcd"
+	Logger "iparking/share/libs/logger"
+
+	"gopkg.in/yaml.v2"
+)
+
+type ConfigSource int
+
+const (
+	ConfigSource_Default ConfigSource = iota
+	ConfigSource_File
+	ConfigSource_Env
+	ConfigSource_ETCD
+)
+
+func (this ConfigSource) String() string {
+	switch this {
+	case ConfigSource_File:
+		return "file"
+	case ConfigSource_Env:
+		return "env"
+	case ConfigSource_ETCD:
+		return "etcd"
+	}
+	return "default"
+}
+
+var (
+	ErrConfig_InvalidTarget = errors.New("config target must be a pointer to a struct")
+	ErrConfig_UnknownFormat = errors.New("config file must be .json, .yaml or .yml")
+	ErrConfig_NotLoaded     = errors.New("config was not loaded")
+)
+
+const maxEnvDepth = 8
+
+var durationType = reflect.TypeOf(time.Duration(0))
+var timeType = reflect.TypeOf(time.Time{})
+
+// ConfigLoader fill a struct of config sections (DBConfig, RedisConfig, ...) from File, then environment
+// variables, then the JSON document at ETCDKey. Later layers override earlier ones field by field.
+//
+// Document keys match the json tag or, case-insensitively, the field name. Environment variables are
+// named EnvPrefix_SECTION_FIELD, e.g. IPARKING_REDIS_STANDALONE_ADDR
+type ConfigLoader struct {
+	File      string
+	EnvPrefix string
+	ETCD      *ETCD.ETCDClient
+	ETCDKey   string
+
+	// Lock held while sections of the target are replaced by a reload, read the target under RLock
+	Lock sync.RWMutex
+
+	target     reflect.Value
+	defaults   reflect.Value
+	sources    map[string]ConfigSource
+	reloads    map[string][]func() error
+	subscribed bool
+}
+
+// Load fill target, a pointer to a struct whose current values act as defaults
+func (this *ConfigLoader) Load(target interface{}) error {
+
+	v := reflect.ValueOf(target)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return ErrConfig_InvalidTarget
+	}
+
+	this.Lock.Lock()
+	this.target = v.Elem()
+	this.defaults = reflect.New(v.Elem().Type()).Elem()
+	this.defaults.Set(v.Elem())
+	this.Lock.Unlock()
+
+	doc, err := this.registerETCD()
+	if err != nil {
+		return err
+	}
+
+	fresh, sources, err := this.build(doc)
+	if err != nil {
+		return err
+	}
+
+	this.Lock.Lock()
+	defer this.Lock.Unlock()
+
+	this.target.Set(fresh)
+	this.sources = sources
+
+	return nil
+}
+
+// OnReload call fn after section, a field name of the target, was changed by ETCD
+func (this *ConfigLoader) OnReload(section string, fn func() error) {
+
+	this.Lock.Lock()
+	defer this.Lock.Unlock()
+
+	if this.reloads == nil {
+		this.reloads = make(map[string][]func() error)
+	}
+
+	this.reloads[section] = append(this.reloads[section], fn)
+}
+
+// Watch follow ETCDKey, reloading sections as it changes. The changes also go to ETCD.WatchChan, which
+// must be read or set to nil
+func (this *ConfigLoader) Watch() (*ETCD.ETCDWatcher, error) {
+
+	this.Lock.RLock()
+	subscribed := this.subscribed
+	this.Lock.RUnlock()
+
+	if this.ETCD == nil || this.ETCDKey == "" || !subscribed {
+		return nil, ErrConfig_NotLoaded
+	}
+
+	return this.ETCD.Watch(this.ETCDKey), nil
+}
+
+// Source layer which set path, e.g. "Redis.Standalone.Addr"
+func (this *ConfigLoader) Source(path string) ConfigSource {
+
+	this.Lock.RLock()
+	defer this.Lock.RUnlock()
+
+	return this.sources[path]
+}
+
+// Sources layer of every field not left to its default, keyed by path
+func (this *ConfigLoader) Sources() map[string]ConfigSource {
+
+	this.Lock.RLock()
+	defer this.Lock.RUnlock()
+
+	sources := make(map[string]ConfigSource, len(this.sources))
+	for path, source := range this.sources {
+		sources[path] = source
+	}
+
+	return sources
+}
+
+// registerETCD register ETCDKey, subscribe to it once and return its current document
+func (this *ConfigLoader) registerETCD() (map[string]interface{}, error) {
+
+	if this.ETCD == nil || this.ETCDKey == "" {
+		return nil, nil
+	}
+
+	config, err := this.ETCD.RegisterConfig(this.ETCDKey, reflect.TypeOf(map[string]interface{}{}))
+	if err != nil {
+		return nil, err
+	}
+
+	this.Lock.Lock()
+	subscribe := !this.subscribed
+	this.subscribed = true
+	this.Lock.Unlock()
+
+	if subscribe {
+		config.Subscribe(func(value interface{}, revision int64) {
+			this.reload(value)
+		})
+	}
+
+	return documentOf(config.Content())
+}
+
+// reload rebuild every layer with the new ETCD document, replace the sections which changed and
+// call their callbacks
+func (this *ConfigLoader) reload(value interface{}) {
+
+	doc, err := documentOf(value)
+	if err == nil {
+		var fresh reflect.Value
+		var sources map[string]ConfigSource
+
+		if fresh, sources, err = this.build(doc); err == nil {
+			this.apply(fresh, sources)
+			return
+		}
+	}
+
+	Logger.WriteLog("Config reload from ETCD key " + this.ETCDKey + " failed : " + err.Error())
+}
+
+func (this *ConfigLoader) apply(fresh reflect.Value, sources map[string]ConfigSource) {
+
+	this.Lock.Lock()
+
+	callbacks := []func() error{}
+	sections := []string{}
+
+	for i := 0; i < fresh.NumField(); i++ {
+		field := fresh.Type().Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+
+		if reflect.DeepEqual(this.target.Field(i).Interface(), fresh.Field(i).Interface()) {
+			continue
+		}
+
+		this.target.Field(i).Set(fresh.Field(i))
+		for _, fn := range this.reloads[field.Name] {
+			callbacks = append(callbacks, fn)
+			sections = append(sections, field.Name)
+		}
+	}
+
+	this.sources = sources
+	this.Lock.Unlock()
+
+	for i, fn := range callbacks {
+		if err := fn(); err != nil {
+			Logger.WriteLog("Config reload of section " + sections[i] + " failed : " + err.Error())
+		}
+	}
+}
+
+// build defaults overridden by file, env and doc
+func (this *ConfigLoader) build(doc map[string]interface{}) (reflect.Value, map[string]ConfigSource, error) {
+
+	this.Lock.RLock()
+	fresh := reflect.New(this.defaults.Type()).Elem()
+	fresh.Set(this.defaults)
+	this.Lock.RUnlock()
+
+	sources := make(map[string]ConfigSource)
+
+	if this.File != "" {
+		file, err := readFile(this.File)
+		if err != nil {
+			return fresh, nil, err
+		}
+		if err = applyDocument(fresh, file, "", ConfigSource_File, sources); err != nil {
+			return fresh, nil, err
+		}
+	}
+
+	if this.EnvPrefix != "" {
+		if _, err := applyEnv(fresh, strings.ToUpper(this.EnvPrefix), "", sources, 0); err != nil {
+			return fresh, nil, err
+		}
+	}
+
+	if doc != nil {
+		if err := applyDocument(fresh, doc, "", ConfigSource_ETCD, sources); err != nil {
+			return fresh, nil, err
+		}
+	}
+
+	return fresh, sources, nil
+}
+
+func readFile(path string) (map[string]interface{}, error) {
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw interface{}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		err = json.Unmarshal(data, &raw)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &raw)
+	default:
+		return nil, ErrConfig_UnknownFormat
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	doc, ok := normalize(raw).(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("config file %s is not a document", path)
+	}
+
+	return doc, nil
+}
+
+// normalize turn yaml maps into the json shape, map[string]interface{} all the way down
+func normalize(raw interface{}) interface{} {
+
+	switch value := raw.(type) {
+	case map[interface{}]interface{}:
+		doc := make(map[string]interface{}, len(value))
+		for k, v := range value {
+			doc[fmt.Sprint(k)] = normalize(v)
+		}
+		return doc
+	case map[string]interface{}:
+		for k, v := range value {
+			value[k] = normalize(v)
+		}
+		return value
+	case []interface{}:
+		for i, v := range value {
+			value[i] = normalize(v)
+		}
+		return value
+	}
+
+	return raw
+}
+
+func documentOf(value interface{}) (map[string]interface{}, error) {
+
+	switch doc := value.(type) {
+	case nil:
+		return nil, nil
+	case *map[string]interface{}:
+		return *doc, nil
+	case map[string]interface{}:
+		return doc, nil
+	}
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	doc := make(map[string]interface{})
+	return doc, json.Unmarshal(data, &doc)
+}
+
+// applyDocument set the fields of v named by doc, copying structs behind pointers before writing
+// so defaults are never modified
+func applyDocument(v reflect.Value, doc map[string]interface{}, path string, source ConfigSource, sources map[string]ConfigSource) error {
+
+	for key, raw := range doc {
+
+		field, name, ok := fieldByKey(v, key)
+		if !ok {
+			continue
+		}
+		fieldPath := joinPath(path, name)
+
+		if sub, ok := raw.(map[string]interface{}); ok && isSection(field.Type()) {
+			if err := applyDocument(writable(field), sub, fieldPath, source, sources); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := setValue(field, raw); err != nil {
+			return fmt.Errorf("config %s : %v", fieldPath, err)
+		}
+		sources[fieldPath] = source
+	}
+
+	return nil
+}
+
+// applyEnv set every field of v which has a variable named prefix_FIELD, returning whether any was set
+func applyEnv(v reflect.Value, prefix string, path string, sources map[string]ConfigSource, depth int) (bool, error) {
+
+	if depth > maxEnvDepth {
+		return false, nil
+	}
+
+	set := false
+
+	for i := 0; i < v.NumField(); i++ {
+
+		info := v.Type().Field(i)
+		if info.PkgPath != "" || info.Anonymous {
+			continue
+		}
+
+		field := v.Field(i)
+		name := prefix + "_" + strings.ToUpper(info.Name)
+		fieldPath := joinPath(path, info.Name)
+
+		if isSection(field.Type()) {
+			if field.Kind() == reflect.Ptr {
+				copied := reflect.New(field.Type().Elem())
+				if !field.IsNil() {
+					copied.Elem().Set(field.Elem())
+				}
+				ok, err := applyEnv(copied.Elem(), name, fieldPath, sources, depth+1)
+				if err != nil {
+					return set, err
+				}
+				if ok {
+					field.Set(copied)
+					set = true
+				}
+				continue
+			}
+
+			ok, err := applyEnv(field, name, fieldPath, sources, depth+1)
+			if err != nil {
+				return set, err
+			}
+			set = set || ok
+			continue
+		}
+
+		switch field.Kind() {
+		case reflect.Func, reflect.Chan, reflect.Interface, reflect.UnsafePointer:
+			continue
+		}
+
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+
+		if err := setEnv(field, value); err != nil {
+			return set, fmt.Errorf("config %s from %s : %v", fieldPath, name, err)
+		}
+
+		sources[fieldPath] = ConfigSource_Env
+		set = true
+	}
+
+	return set, nil
+}
+
+func fieldByKey(v reflect.Value, key string) (reflect.Value, string, bool) {
+
+	for i := 0; i < v.NumField(); i++ {
+
+		info := v.Type().Field(i)
+		if info.PkgPath != "" {
+			continue
+		}
+
+		tag := strings.Split(info.Tag.Get("json"), ",")[0]
+		if tag == "-" {
+			continue
+		}
+
+		if tag == key || strings.EqualFold(info.Name, key) || (tag != "" && strings.EqualFold(tag, key)) {
+			return v.Field(i), info.Name, true
+		}
+	}
+
+	return reflect.Value{}, "", false
+}
+
+// isSection struct, or pointer to struct, whose fields are filled one by one
+func isSection(t reflect.Type) bool {
+
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	return t.Kind() == reflect.Struct && t != timeType
+}
+
+// writable struct value behind field, a pointer is replaced by a new copy of what it pointed to
+func writable(field reflect.Value) reflect.Value {
+
+	if field.Kind() != reflect.Ptr {
+		return field
+	}
+
+	copied := reflect.New(field.Type().Elem())
+	if !field.IsNil() {
+		copied.Elem().Set(field.Elem())
+	}
+	field.Set(copied)
+
+	return copied.Elem()
+}
+
+func setValue(field reflect.Value, raw interface{}) error {
+
+	if s, ok := raw.(string); ok && field.Type() == durationType {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+		return nil
+	}
+
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return err
+	}
+
+	value := reflect.New(field.Type())
+	if err = json.Unmarshal(data, value.Interface()); err != nil {
+		return err
+	}
+
+	field.Set(value.Elem())
+	return nil
+}
+
+func setEnv(field reflect.Value, value string) error {
+
+	if field.Kind() == reflect.String {
+		field.SetString(value)
+		return nil
+	}
+
+	if field.Type() == durationType {
+		if d, err := time.ParseDuration(value); err == nil {
+			field.SetInt(int64(d))
+			return nil
+		}
+	}
+
+	parsed := reflect.New(field.Type())
+	err := json.Unmarshal([]byte(value), parsed.Interface())
+
+	if err != nil && field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.String {
+		items := strings.Split(value, ",")
+		slice := reflect.MakeSlice(field.Type(), len(items), len(items))
+		for i, item := range items {
+			slice.Index(i).SetString(strings.TrimSpace(item))
+		}
+		field.Set(slice)
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	field.Set(parsed.Elem())
+	return nil
+}
+
+func joinPath(path string, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
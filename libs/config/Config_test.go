@@ -0,0 +1,124 @@
+package Config
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	ETCD "iparking/share/libs/etcd"
+	ETCDTest "iparking/share/libs/etcd/etcdtest"
+
+	etcd "github.com/coreos/etcd/clientv3"
+)
+
+type testRedisConfig struct {
+	Addr string `json:"addr"`
+	DB   int    `json:"db"`
+}
+
+type testDBConfig struct {
+	Host string `json:"host"`
+}
+
+type testConfig struct {
+	Redis testRedisConfig `json:"redis"`
+	DB    testDBConfig    `json:"db"`
+}
+
+func TestConfigLoader_WatchReloads(t *testing.T) {
+
+	fake := ETCDTest.NewFakeETCD()
+	client := &ETCD.ETCDClient{}
+	client.InitWith(fake, fake)
+	client.WatchChan = nil
+	defer client.StopWatch()
+
+	put := func(doc string) {
+		if _, err := fake.Put(context.Background(), "config/app", doc); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+
+	put(`{"redis":{"addr":"redis:6379"},"db":{"host":"db-1"}}`)
+
+	conf := &testConfig{Redis: testRedisConfig{DB: 2}}
+	loader := &ConfigLoader{ETCD: client, ETCDKey: "config/app"}
+	if err := loader.Load(conf); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	if conf.Redis.Addr != "redis:6379" || conf.Redis.DB != 2 || conf.DB.Host != "db-1" {
+		t.Fatalf("Load = %+v", conf)
+	}
+
+	reloads := make(chan testRedisConfig, 4)
+	loader.OnReload("Redis", func() error {
+		loader.Lock.RLock()
+		defer loader.Lock.RUnlock()
+
+		reloads <- conf.Redis
+		return nil
+	})
+
+	watcher, err := loader.Watch()
+	if err != nil {
+		t.Fatalf("Watch: %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for watcher.State() != ETCD.ETCDWatch_Connected {
+		if time.Now().After(deadline) {
+			t.Fatal("watcher not connected")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// the loader relies on subscribers only, successive changes must all reach it
+	for _, addr := range []string{"redis-a:6379", "redis-b:6379"} {
+		put(`{"redis":{"addr":"` + addr + `"},"db":{"host":"db-1"}}`)
+
+		select {
+		case redis := <-reloads:
+			if redis.Addr != addr || redis.DB != 2 {
+				t.Fatalf("reloaded Redis = %+v, want addr %s db 2", redis, addr)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no reload after changing addr to %s", addr)
+		}
+	}
+
+	if got := loader.Source("Redis.Addr"); got != ConfigSource_ETCD {
+		t.Fatalf("Source(Redis.Addr) = %s, want etcd", got)
+	}
+
+	select {
+	case redis := <-reloads:
+		t.Fatalf("unexpected reload %+v", redis)
+	default:
+	}
+}
+
+// unreachableKV KV whose reads fail as if etcd could not be reached
+type unreachableKV struct {
+	etcd.KV
+}
+
+var errUnreachable = errors.New("etcd unreachable")
+
+func (this unreachableKV) Get(ctx context.Context, key string, opts ...etcd.OpOption) (*etcd.GetResponse, error) {
+	return nil, errUnreachable
+}
+
+func TestConfigLoader_LoadETCDError(t *testing.T) {
+
+	fake := ETCDTest.NewFakeETCD()
+	client := &ETCD.ETCDClient{}
+	client.InitWith(unreachableKV{KV: fake}, fake)
+
+	conf := &testConfig{}
+	loader := &ConfigLoader{ETCD: client, ETCDKey: "config/app"}
+	if err := loader.Load(conf); err != errUnreachable {
+		t.Fatalf("Load = %v, want the etcd error", err)
+	}
+}
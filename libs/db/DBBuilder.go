@@ -0,0 +1,326 @@
+package DB
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"reflect"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+var (
+	// ErrDB_NotStruct ...
+	ErrDB_NotStruct = errors.New("DB: row must be a struct or pointer to struct")
+	// ErrDB_NoColumn ...
+	ErrDB_NoColumn = errors.New("DB: row has no column")
+	// ErrDB_EmptyRows ...
+	ErrDB_EmptyRows = errors.New("DB: rows must be a non empty slice")
+	// ErrDB_EmptyWhere ...
+	ErrDB_EmptyWhere = errors.New("DB: update requires a where clause")
+	// ErrDB_UpsertMysqlOnly ...
+	ErrDB_UpsertMysqlOnly = errors.New("DB: upsert is supported on mysql only")
+	// ErrDB_UpsertNoUpdate ...
+	ErrDB_UpsertNoUpdate = errors.New("DB: upsert requires the columns to update")
+)
+
+// QueryBuilder generate INSERT/UPDATE statements from `db:"col"` tagged structs, same tags as Select/Get.
+// A field tagged `db:"col,omitempty"` is left out when it holds the zero value (eg. auto increment id),
+// `db:"-"` is never written
+type QueryBuilder struct {
+	dbType string
+}
+
+// Builder query builder for the dialect of this instance
+func (this *DBInstance) Builder() QueryBuilder {
+	return QueryBuilder{dbType: this.dbType()}
+}
+
+type column struct {
+	name      string
+	omitEmpty bool
+	value     reflect.Value
+}
+
+// columns flatten tagged fields of struct v, including embedded structs
+func columns(v reflect.Value) []column {
+
+	var cols []column
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+
+		field := t.Field(i)
+		tag := field.Tag.Get("db")
+		if tag == "-" {
+			continue
+		}
+
+		if field.Anonymous && len(tag) == 0 {
+			fv := v.Field(i)
+			if fv.Kind() == reflect.Ptr {
+				if fv.IsNil() {
+					continue
+				}
+				fv = fv.Elem()
+			}
+			if fv.Kind() == reflect.Struct {
+				cols = append(cols, columns(fv)...)
+				continue
+			}
+		}
+
+		if len(field.PkgPath) > 0 {
+			// unexported
+			continue
+		}
+
+		name, opts := tag, ""
+		if idx := strings.Index(tag, ","); idx >= 0 {
+			name, opts = tag[:idx], tag[idx+1:]
+		}
+		if len(name) == 0 {
+			// sqlx default name mapper
+			name = strings.ToLower(field.Name)
+		}
+
+		cols = append(cols, column{
+			name:      name,
+			omitEmpty: strings.Contains(opts, "omitempty"),
+			value:     v.Field(i),
+		})
+	}
+
+	return cols
+}
+
+func structValue(row interface{}) (reflect.Value, error) {
+
+	v := reflect.ValueOf(row)
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return v, ErrDB_NotStruct
+		}
+		v = v.Elem()
+	}
+
+	if v.Kind() != reflect.Struct {
+		return v, ErrDB_NotStruct
+	}
+
+	return v, nil
+}
+
+// rowColumns columns of row to write, omitempty zero fields excluded
+func rowColumns(row interface{}) ([]string, []interface{}, error) {
+
+	v, err := structValue(row)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var names []string
+	var args []interface{}
+	for _, col := range columns(v) {
+		if col.omitEmpty && col.value.IsZero() {
+			continue
+		}
+		names = append(names, col.name)
+		args = append(args, col.value.Interface())
+	}
+
+	if len(names) == 0 {
+		return nil, nil, ErrDB_NoColumn
+	}
+
+	return names, args, nil
+}
+
+func (this QueryBuilder) quote(ident string) string {
+
+	q := "`"
+	if this.dbType == DBType_Postgres {
+		q = `"`
+	}
+
+	parts := strings.Split(ident, ".")
+	for i := range parts {
+		parts[i] = q + strings.Replace(parts[i], q, q+q, -1) + q
+	}
+
+	return strings.Join(parts, ".")
+}
+
+func (this QueryBuilder) quoteAll(idents []string) string {
+
+	quoted := make([]string, len(idents))
+	for i := range idents {
+		quoted[i] = this.quote(idents[i])
+	}
+
+	return strings.Join(quoted, ", ")
+}
+
+// Rebind convert ? placeholders to the dialect bindvar
+func (this QueryBuilder) Rebind(query string) string {
+	return sqlx.Rebind(sqlx.BindType(this.dbType), query)
+}
+
+func placeholders(n int) string {
+	return "(" + strings.TrimSuffix(strings.Repeat("?, ", n), ", ") + ")"
+}
+
+// Insert INSERT INTO table (...) VALUES (...)
+func (this QueryBuilder) Insert(table string, row interface{}) (string, []interface{}, error) {
+
+	names, args, err := rowColumns(row)
+	if err != nil {
+		return "", nil, err
+	}
+
+	query := "INSERT INTO " + this.quote(table) + " (" + this.quoteAll(names) + ") VALUES " + placeholders(len(names))
+	return this.Rebind(query), args, nil
+}
+
+// BulkInsert multi-row INSERT of a slice of structs. An omitempty column is left out only when it
+// is zero in every row
+func (this QueryBuilder) BulkInsert(table string, rows interface{}) (string, []interface{}, error) {
+
+	v := reflect.ValueOf(rows)
+	if v.Kind() != reflect.Slice || v.Len() == 0 {
+		return "", nil, ErrDB_EmptyRows
+	}
+
+	structs := make([][]column, v.Len())
+	for i := range structs {
+		sv, err := structValue(v.Index(i).Interface())
+		if err != nil {
+			return "", nil, err
+		}
+		structs[i] = columns(sv)
+		if len(structs[i]) != len(structs[0]) {
+			// nil embedded pointer in some rows
+			return "", nil, ErrDB_NoColumn
+		}
+	}
+
+	var names []string
+	var keep []int
+	for c, col := range structs[0] {
+		used := !col.omitEmpty
+		for i := 0; !used && i < len(structs); i++ {
+			used = !structs[i][c].value.IsZero()
+		}
+		if used {
+			names = append(names, col.name)
+			keep = append(keep, c)
+		}
+	}
+
+	if len(names) == 0 {
+		return "", nil, ErrDB_NoColumn
+	}
+
+	values := make([]string, len(structs))
+	args := make([]interface{}, 0, len(structs)*len(keep))
+	for i := range structs {
+		values[i] = placeholders(len(keep))
+		for _, c := range keep {
+			args = append(args, structs[i][c].value.Interface())
+		}
+	}
+
+	query := "INSERT INTO " + this.quote(table) + " (" + this.quoteAll(names) + ") VALUES " + strings.Join(values, ", ")
+	return this.Rebind(query), args, nil
+}
+
+// Update UPDATE table SET ... WHERE where, where uses ? placeholders bound to whereArgs
+func (this QueryBuilder) Update(table string, row interface{}, where string, whereArgs ...interface{}) (string, []interface{}, error) {
+
+	if len(strings.TrimSpace(where)) == 0 {
+		return "", nil, ErrDB_EmptyWhere
+	}
+
+	names, args, err := rowColumns(row)
+	if err != nil {
+		return "", nil, err
+	}
+
+	sets := make([]string, len(names))
+	for i := range names {
+		sets[i] = this.quote(names[i]) + " = ?"
+	}
+
+	query := "UPDATE " + this.quote(table) + " SET " + strings.Join(sets, ", ") + " WHERE " + where
+	return this.Rebind(query), append(args, whereArgs...), nil
+}
+
+// Upsert INSERT ... ON DUPLICATE KEY UPDATE, updating updateCols. The builder does not know the primary
+// and unique keys of table, so updateCols is required and should leave them out
+func (this QueryBuilder) Upsert(table string, row interface{}, updateCols ...string) (string, []interface{}, error) {
+
+	if this.dbType == DBType_Postgres {
+		return "", nil, ErrDB_UpsertMysqlOnly
+	}
+
+	if len(updateCols) == 0 {
+		return "", nil, ErrDB_UpsertNoUpdate
+	}
+
+	query, args, err := this.Insert(table, row)
+	if err != nil {
+		return "", nil, err
+	}
+
+	sets := make([]string, len(updateCols))
+	for i := range updateCols {
+		col := this.quote(updateCols[i])
+		sets[i] = col + " = VALUES(" + col + ")"
+	}
+
+	return query + " ON DUPLICATE KEY UPDATE " + strings.Join(sets, ", "), args, nil
+}
+
+// Insert insert row into table on master
+func (this *DBInstance) Insert(ctx context.Context, table string, row interface{}) (sql.Result, error) {
+
+	query, args, err := this.Builder().Insert(table, row)
+	if err != nil {
+		return nil, err
+	}
+
+	return this.ExecContext(ctx, query, args...)
+}
+
+// BulkInsert insert a slice of rows into table with a single statement on master
+func (this *DBInstance) BulkInsert(ctx context.Context, table string, rows interface{}) (sql.Result, error) {
+
+	query, args, err := this.Builder().BulkInsert(table, rows)
+	if err != nil {
+		return nil, err
+	}
+
+	return this.ExecContext(ctx, query, args...)
+}
+
+// Update update table from row where clause matches, on master
+func (this *DBInstance) Update(ctx context.Context, table string, row interface{}, where string, whereArgs ...interface{}) (sql.Result, error) {
+
+	query, args, err := this.Builder().Update(table, row, where, whereArgs...)
+	if err != nil {
+		return nil, err
+	}
+
+	return this.ExecContext(ctx, query, args...)
+}
+
+// Upsert insert row, or update updateCols on duplicate key, on master
+func (this *DBInstance) Upsert(ctx context.Context, table string, row interface{}, updateCols ...string) (sql.Result, error) {
+
+	query, args, err := this.Builder().Upsert(table, row, updateCols...)
+	if err != nil {
+		return nil, err
+	}
+
+	return this.ExecContext(ctx, query, args...)
+}
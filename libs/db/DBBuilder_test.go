@@ -0,0 +1,55 @@
+package DB
+
+import (
+	"reflect"
+	"testing"
+)
+
+type builderLot struct {
+	ID       int64  `db:"id,omitempty"`
+	Code     string `db:"code"`
+	Capacity int    `db:"capacity"`
+}
+
+func TestQueryBuilder_Upsert(t *testing.T) {
+
+	builder := QueryBuilder{dbType: DBType_MySQL}
+	row := builderLot{ID: 7, Code: "north", Capacity: 120}
+
+	if _, _, err := builder.Upsert("lots", row); err != ErrDB_UpsertNoUpdate {
+		t.Fatalf("Upsert without updateCols = %v, want ErrDB_UpsertNoUpdate", err)
+	}
+
+	query, args, err := builder.Upsert("lots", row, "capacity")
+	if err != nil {
+		t.Fatalf("Upsert: %v", err)
+	}
+
+	want := "INSERT INTO `lots` (`id`, `code`, `capacity`) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE `capacity` = VALUES(`capacity`)"
+	if query != want {
+		t.Fatalf("query = %s, want %s", query, want)
+	}
+	if !reflect.DeepEqual(args, []interface{}{int64(7), "north", 120}) {
+		t.Fatalf("args = %v", args)
+	}
+
+	if _, _, err := (QueryBuilder{dbType: DBType_Postgres}).Upsert("lots", row, "capacity"); err != ErrDB_UpsertMysqlOnly {
+		t.Fatalf("postgres Upsert = %v, want ErrDB_UpsertMysqlOnly", err)
+	}
+}
+
+func TestQueryBuilder_InsertOmitEmpty(t *testing.T) {
+
+	query, args, err := QueryBuilder{dbType: DBType_Postgres}.Insert("lots", &builderLot{Code: "south"})
+	if err != nil {
+		t.Fatalf("Insert: %v", err)
+	}
+
+	want := `INSERT INTO "lots" ("code", "capacity") VALUES ($1, $2)`
+	if query != want {
+		t.Fatalf("query = %s, want %s", query, want)
+	}
+	if !reflect.DeepEqual(args, []interface{}{"south", 0}) {
+		t.Fatalf("args = %v", args)
+	}
+}
@@ -1,7 +1,11 @@
 package DB
 
 type DBConfig struct {
-	Type                    string
+
+	// mysql
+	// postgres
+	Type string
+
 	DB                      string
 	Username                string
 	Password                string
@@ -11,8 +15,35 @@ type DBConfig struct {
 	ClientCert              string
 	ClientKey               string
 	Tls                     string
+	TlsMode                 string // verify-full (default), verify-ca
+	TlsMinVersion           string // 1.2 (default), 1.3
+	TlsCipherPolicy         string // modern (default), compatible
 	Args                    string
 	MaxIdleConn             int
 	MaxOpenConn             int
 	ConnMaxLifetimeInMinute int
+
+	// seconds Connect waits for in-flight queries of the previous pool before destroying it, default 30
+	DrainTimeoutInSecond int
+
+	// default deadline of Exec/Select/Get when caller context has none, 0 means no deadline
+	QueryTimeoutInSecond int
+
+	// max attempts of WithTx on deadlock/lock wait timeout, 0 or 1 means no retry
+	TxMaxAttempts int
+
+	// probe slaves every HealthCheckIntervalInSecond, 0 disables health check.
+	// Slaves lagging more than SlaveMaxLagInSecond are taken out of read rotation, 0 means no lag limit
+	HealthCheckIntervalInSecond int
+	SlaveMaxLagInSecond         int
+
+	// read-your-writes (see WithReadYourWrites): reads go to master for StickyMasterInSecond after a write (default 5).
+	// With ReadYourWritesGTID (mysql only) a slave is used as soon as it has applied the write's GTID
+	StickyMasterInSecond int
+	ReadYourWritesGTID   bool
+
+	// queries slower than SlowQueryInMillisecond are logged with their fingerprint, 0 disables.
+	// Pool stats are pushed to DBInstance metrics every MetricsIntervalInSecond (default 15)
+	SlowQueryInMillisecond  int
+	MetricsIntervalInSecond int
 }
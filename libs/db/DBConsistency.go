@@ -0,0 +1,155 @@
+package DB
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	defaultStickyWindow = 5 * time.Second
+)
+
+type dbSessionKey struct{}
+
+// dbSession writes seen by a read-your-writes context
+type dbSession struct {
+	lock      sync.RWMutex
+	lastWrite time.Time
+	gtid      string
+}
+
+// WithReadYourWrites return a context in which reads following a write go to master,
+// until DBConfig.StickyMasterInSecond passes or (mysql with ReadYourWritesGTID) the slave
+// has applied the write. Contexts derived from the result share the same session
+func WithReadYourWrites(ctx context.Context) context.Context {
+
+	if sessionFrom(ctx) != nil {
+		return ctx
+	}
+
+	return context.WithValue(ctx, dbSessionKey{}, &dbSession{})
+}
+
+func sessionFrom(ctx context.Context) *dbSession {
+
+	session, _ := ctx.Value(dbSessionKey{}).(*dbSession)
+	return session
+}
+
+func (this *dbSession) wrote(gtid string) {
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.lastWrite = time.Now()
+	this.gtid = gtid
+}
+
+// pending return whether the last write may not be visible on slaves yet, with its gtid set
+func (this *dbSession) pending(window time.Duration) (bool, string) {
+
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	if this.lastWrite.IsZero() || time.Since(this.lastWrite) >= window {
+		return false, ""
+	}
+
+	return true, this.gtid
+}
+
+// caughtUp forget the last write once a slave confirmed it has applied gtid
+func (this *dbSession) caughtUp(gtid string) {
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.gtid == gtid {
+		this.lastWrite = time.Time{}
+		this.gtid = ""
+	}
+}
+
+// markWrite record a successful write for the read-your-writes session of ctx, if any
+func (this *dbPool) markWrite(ctx context.Context) {
+
+	session := sessionFrom(ctx)
+	if session == nil {
+		return
+	}
+
+	gtid := ""
+	if this.trackGTID {
+		if master, _ := this.db.GetMaster(); master != nil {
+			// on failure gtid stays empty and reads fall back to the time window
+			if err := master.GetContext(ctx, &gtid, "SELECT @@GLOBAL.gtid_executed"); err != nil {
+				gtid = ""
+			}
+		}
+	}
+
+	session.wrote(gtid)
+}
+
+// markTxBegin record a write for the session of ctx when a transaction it cannot see committing begins.
+// No gtid: the transaction writes are not executed yet, reads stay on master for the whole window
+func (this *dbPool) markTxBegin(ctx context.Context) {
+
+	if session := sessionFrom(ctx); session != nil {
+		session.wrote("")
+	}
+}
+
+// reader choose where a read in ctx goes: master while a session write is pending, otherwise a slave.
+// Return the reader and its role
+func (this *dbPool) reader(ctx context.Context) (dbReader, string) {
+
+	session := sessionFrom(ctx)
+	if session == nil {
+		return this.slaveReader()
+	}
+
+	window := this.stickyWindow
+	if window <= 0 {
+		window = defaultStickyWindow
+	}
+
+	pending, gtid := session.pending(window)
+	if !pending {
+		return this.slaveReader()
+	}
+
+	if len(gtid) > 0 {
+		if slave := this.pickSlave(); slave != nil && hasApplied(ctx, slave, gtid) {
+			session.caughtUp(gtid)
+			return slave, DBRole_Slave
+		}
+	}
+
+	return this.masterReader()
+}
+
+// pickSlave a single slave connection, healthy one when health check is enabled
+func (this *dbPool) pickSlave() *sqlx.DB {
+
+	if this.health != nil {
+		return this.health.pick()
+	}
+
+	slave, _ := this.db.GetSlave()
+	return slave
+}
+
+// hasApplied check whether slave has executed every transaction of gtid set
+func hasApplied(ctx context.Context, slave *sqlx.DB, gtid string) bool {
+
+	var applied bool
+	if err := slave.GetContext(ctx, &applied, "SELECT GTID_SUBSET(?, @@GLOBAL.gtid_executed)", gtid); err != nil {
+		return false
+	}
+
+	return applied
+}
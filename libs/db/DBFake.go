@@ -0,0 +1,475 @@
+package DB
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// DBExecutor query surface of DBInstance, depend on it instead of *DBInstance so FakeDB can stand in tests
+type DBExecutor interface {
+	Begin() (*sql.Tx, error)
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	Select(dest interface{}, query string, args ...interface{}) error
+	SelectContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error
+	Get(dest interface{}, query string, args ...interface{}) error
+	GetContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error
+}
+
+var (
+	_ DBExecutor = (*DBInstance)(nil)
+	_ DBExecutor = (*FakeDB)(nil)
+)
+
+const fakeDriverName = "iparking-dbfake"
+
+var (
+	fakeRegistry   = make(map[string]*FakeDB)
+	fakeRegistryMu sync.Mutex
+	fakeSeq        uint64
+	fakeOnce       sync.Once
+)
+
+type fakeKind string
+
+const (
+	fakeKind_Exec     fakeKind = "exec"
+	fakeKind_Query    fakeKind = "query"
+	fakeKind_Begin    fakeKind = "begin"
+	fakeKind_Commit   fakeKind = "commit"
+	fakeKind_Rollback fakeKind = "rollback"
+)
+
+// FakeExpectation one scripted call of FakeDB
+type FakeExpectation struct {
+	kind         fakeKind
+	query        string
+	args         []driver.Value
+	anyArgs      bool
+	columns      []string
+	rows         [][]driver.Value
+	lastInsertID int64
+	rowsAffected int64
+	err          error
+	met          bool
+}
+
+// FakeDB in-memory DBExecutor replaying scripted expectations in order. Every call must match the
+// next expectation (same kind, same query modulo whitespace, same args when WithArgs is used).
+// Rows are given as db-tagged structs and scanned back by sqlx exactly like a real Select/Get
+type FakeDB struct {
+	name         string
+	db           *sqlx.DB
+	lock         sync.Mutex
+	expectations []*FakeExpectation
+	failures     []string
+}
+
+// NewFakeDB ...
+func NewFakeDB() *FakeDB {
+
+	fakeOnce.Do(func() {
+		sql.Register(fakeDriverName, fakeDriver{})
+	})
+
+	fake := &FakeDB{name: "fake-" + strconv.FormatUint(atomic.AddUint64(&fakeSeq, 1), 10)}
+
+	fakeRegistryMu.Lock()
+	fakeRegistry[fake.name] = fake
+	fakeRegistryMu.Unlock()
+
+	db, _ := sql.Open(fakeDriverName, fake.name)
+	fake.db = sqlx.NewDb(db, DBType_MySQL)
+
+	return fake
+}
+
+// Close release the fake
+func (this *FakeDB) Close() error {
+
+	fakeRegistryMu.Lock()
+	delete(fakeRegistry, this.name)
+	fakeRegistryMu.Unlock()
+
+	return this.db.Close()
+}
+
+func (this *FakeDB) expect(kind fakeKind, query string) *FakeExpectation {
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	e := &FakeExpectation{kind: kind, query: normalizeQuery(query), anyArgs: true}
+	this.expectations = append(this.expectations, e)
+
+	return e
+}
+
+// ExpectExec script an Exec (also inside a transaction)
+func (this *FakeDB) ExpectExec(query string) *FakeExpectation {
+	return this.expect(fakeKind_Exec, query)
+}
+
+// ExpectQuery script a Select or Get (also inside a transaction)
+func (this *FakeDB) ExpectQuery(query string) *FakeExpectation {
+	return this.expect(fakeKind_Query, query)
+}
+
+// ExpectBegin script a Begin/BeginTx
+func (this *FakeDB) ExpectBegin() *FakeExpectation {
+	return this.expect(fakeKind_Begin, "")
+}
+
+// ExpectCommit script a Commit
+func (this *FakeDB) ExpectCommit() *FakeExpectation {
+	return this.expect(fakeKind_Commit, "")
+}
+
+// ExpectRollback script a Rollback
+func (this *FakeDB) ExpectRollback() *FakeExpectation {
+	return this.expect(fakeKind_Rollback, "")
+}
+
+// WithArgs expected query args, compared after driver conversion
+func (this *FakeExpectation) WithArgs(args ...interface{}) *FakeExpectation {
+
+	this.anyArgs = false
+	this.args = make([]driver.Value, len(args))
+	for i := range args {
+		v, err := driver.DefaultParameterConverter.ConvertValue(args[i])
+		if err != nil {
+			panic(err)
+		}
+		this.args[i] = v
+	}
+
+	return this
+}
+
+// WillReturnRows rows of a query, a db-tagged struct or a slice of them
+func (this *FakeExpectation) WillReturnRows(rows interface{}) *FakeExpectation {
+
+	v := reflect.ValueOf(rows)
+	for v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+
+	items := []reflect.Value{v}
+	if v.Kind() == reflect.Slice {
+		items = make([]reflect.Value, v.Len())
+		for i := range items {
+			items[i] = v.Index(i)
+		}
+	}
+
+	this.columns, this.rows = nil, [][]driver.Value{}
+	if len(items) == 0 {
+		// no rows, still report the columns of the element type
+		t := v.Type().Elem()
+		for t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		sv, err := structValue(reflect.New(t).Interface())
+		if err != nil {
+			panic(err)
+		}
+		for _, col := range columns(sv) {
+			this.columns = append(this.columns, col.name)
+		}
+		return this
+	}
+
+	for _, item := range items {
+
+		sv, err := structValue(item.Interface())
+		if err != nil {
+			panic(err)
+		}
+
+		cols := columns(sv)
+		row := make([]driver.Value, len(cols))
+		names := make([]string, len(cols))
+		for i, col := range cols {
+			names[i] = col.name
+			value, err := driver.DefaultParameterConverter.ConvertValue(col.value.Interface())
+			if err != nil {
+				panic(err)
+			}
+			row[i] = value
+		}
+
+		this.columns = names
+		this.rows = append(this.rows, row)
+	}
+
+	return this
+}
+
+// WillReturnResult result of an Exec
+func (this *FakeExpectation) WillReturnResult(lastInsertID, rowsAffected int64) *FakeExpectation {
+	this.lastInsertID, this.rowsAffected = lastInsertID, rowsAffected
+	return this
+}
+
+// WillReturnError make the call fail with err
+func (this *FakeExpectation) WillReturnError(err error) *FakeExpectation {
+	this.err = err
+	return this
+}
+
+// ExpectationsWereMet error listing unexpected calls and expectations never reached
+func (this *FakeDB) ExpectationsWereMet() error {
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	problems := append([]string{}, this.failures...)
+	for _, e := range this.expectations {
+		if !e.met {
+			problems = append(problems, fmt.Sprintf("expected %s %q was not called", e.kind, e.query))
+		}
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("DB fake: %s", strings.Join(problems, "; "))
+}
+
+// next consume the next expectation if the call matches it
+func (this *FakeDB) next(kind fakeKind, query string, args []driver.NamedValue) (*FakeExpectation, error) {
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	query = normalizeQuery(query)
+
+	var e *FakeExpectation
+	for _, candidate := range this.expectations {
+		if !candidate.met {
+			e = candidate
+			break
+		}
+	}
+
+	fail := func(format string, a ...interface{}) (*FakeExpectation, error) {
+		err := fmt.Errorf(format, a...)
+		this.failures = append(this.failures, err.Error())
+		return nil, err
+	}
+
+	if e == nil {
+		return fail("unexpected %s %q", kind, query)
+	}
+
+	if e.kind != kind || e.query != query {
+		return fail("unexpected %s %q, next expectation is %s %q", kind, query, e.kind, e.query)
+	}
+
+	if !e.anyArgs {
+		actual := make([]driver.Value, len(args))
+		for i := range args {
+			actual[i] = args[i].Value
+		}
+		if len(actual) != len(e.args) || (len(actual) > 0 && !reflect.DeepEqual(actual, e.args)) {
+			return fail("%s %q called with args %v, expected %v", kind, query, actual, e.args)
+		}
+	}
+
+	e.met = true
+	return e, e.err
+}
+
+func normalizeQuery(query string) string {
+	return strings.Join(strings.Fields(query), " ")
+}
+
+func (this *FakeDB) Begin() (*sql.Tx, error) {
+	return this.db.Begin()
+}
+
+func (this *FakeDB) BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error) {
+	return this.db.BeginTx(ctx, opts)
+}
+
+func (this *FakeDB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return this.db.Exec(query, args...)
+}
+
+func (this *FakeDB) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return this.db.ExecContext(ctx, query, args...)
+}
+
+func (this *FakeDB) Select(dest interface{}, query string, args ...interface{}) error {
+	return this.db.Select(dest, query, args...)
+}
+
+func (this *FakeDB) SelectContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	return this.db.SelectContext(ctx, dest, query, args...)
+}
+
+func (this *FakeDB) Get(dest interface{}, query string, args ...interface{}) error {
+	return this.db.Get(dest, query, args...)
+}
+
+func (this *FakeDB) GetContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	return this.db.GetContext(ctx, dest, query, args...)
+}
+
+// database/sql driver backing FakeDB
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) {
+
+	fakeRegistryMu.Lock()
+	defer fakeRegistryMu.Unlock()
+
+	fake, ok := fakeRegistry[name]
+	if !ok {
+		return nil, fmt.Errorf("DB fake: %s is closed", name)
+	}
+
+	return &fakeConn{fake: fake}, nil
+}
+
+type fakeConn struct {
+	fake *FakeDB
+}
+
+func (this *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{conn: this, query: query}, nil
+}
+
+func (this *fakeConn) Close() error {
+	return nil
+}
+
+func (this *fakeConn) Begin() (driver.Tx, error) {
+	return this.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (this *fakeConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+
+	if _, err := this.fake.next(fakeKind_Begin, "", nil); err != nil {
+		return nil, err
+	}
+
+	return &fakeTx{fake: this.fake}, nil
+}
+
+func (this *fakeConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+
+	e, err := this.fake.next(fakeKind_Exec, query, args)
+	if err != nil {
+		return nil, err
+	}
+
+	return fakeResult{lastInsertID: e.lastInsertID, rowsAffected: e.rowsAffected}, nil
+}
+
+func (this *fakeConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+
+	e, err := this.fake.next(fakeKind_Query, query, args)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fakeRows{columns: e.columns, rows: e.rows}, nil
+}
+
+type fakeStmt struct {
+	conn  *fakeConn
+	query string
+}
+
+func (this *fakeStmt) Close() error {
+	return nil
+}
+
+func (this *fakeStmt) NumInput() int {
+	return -1
+}
+
+func (this *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return this.conn.ExecContext(context.Background(), this.query, namedValues(args))
+}
+
+func (this *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return this.conn.QueryContext(context.Background(), this.query, namedValues(args))
+}
+
+func namedValues(args []driver.Value) []driver.NamedValue {
+
+	named := make([]driver.NamedValue, len(args))
+	for i := range args {
+		named[i] = driver.NamedValue{Ordinal: i + 1, Value: args[i]}
+	}
+
+	return named
+}
+
+type fakeTx struct {
+	fake *FakeDB
+}
+
+func (this *fakeTx) Commit() error {
+	_, err := this.fake.next(fakeKind_Commit, "", nil)
+	return err
+}
+
+func (this *fakeTx) Rollback() error {
+	_, err := this.fake.next(fakeKind_Rollback, "", nil)
+	return err
+}
+
+type fakeResult struct {
+	lastInsertID int64
+	rowsAffected int64
+}
+
+func (this fakeResult) LastInsertId() (int64, error) {
+	return this.lastInsertID, nil
+}
+
+func (this fakeResult) RowsAffected() (int64, error) {
+	return this.rowsAffected, nil
+}
+
+type fakeRows struct {
+	columns []string
+	rows    [][]driver.Value
+	next    int
+}
+
+func (this *fakeRows) Columns() []string {
+	return this.columns
+}
+
+func (this *fakeRows) Close() error {
+	return nil
+}
+
+func (this *fakeRows) Next(dest []driver.Value) error {
+
+	if this.next >= len(this.rows) {
+		return io.EOF
+	}
+
+	copy(dest, this.rows[this.next])
+	this.next++
+
+	return nil
+}
@@ -0,0 +1,210 @@
+package DB
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fakeLot struct {
+	ID        int64          `db:"id"`
+	Name      string         `db:"name"`
+	Capacity  int            `db:"capacity"`
+	Note      sql.NullString `db:"note"`
+	CreatedAt time.Time      `db:"created_at"`
+}
+
+func TestFakeDB_SelectRows(t *testing.T) {
+
+	fake := NewFakeDB()
+	defer fake.Close()
+
+	created := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	want := []fakeLot{
+		{ID: 1, Name: "north", Capacity: 120, Note: sql.NullString{String: "roof", Valid: true}, CreatedAt: created},
+		{ID: 2, Name: "south", Capacity: 80, CreatedAt: created},
+	}
+
+	fake.ExpectQuery("SELECT * FROM lots WHERE zone = ? AND capacity > ?").
+		WithArgs("A", 10).
+		WillReturnRows(want)
+
+	var got []fakeLot
+	err := fake.Select(&got, "SELECT *\n\tFROM lots WHERE zone = ? AND capacity > ?", "A", 10)
+	if err != nil {
+		t.Fatalf("Select: %v", err)
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Select rows = %+v, want %+v", got, want)
+	}
+
+	if err := fake.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFakeDB_SelectNoRows(t *testing.T) {
+
+	fake := NewFakeDB()
+	defer fake.Close()
+
+	fake.ExpectQuery("SELECT * FROM lots").WillReturnRows([]*fakeLot{})
+
+	got := []fakeLot{}
+	if err := fake.Select(&got, "SELECT * FROM lots"); err != nil {
+		t.Fatalf("Select: %v", err)
+	}
+	if len(got) != 0 {
+		t.Fatalf("Select rows = %+v, want none", got)
+	}
+}
+
+func TestFakeDB_GetRow(t *testing.T) {
+
+	fake := NewFakeDB()
+	defer fake.Close()
+
+	want := fakeLot{ID: 7, Name: "east", Capacity: 40}
+	fake.ExpectQuery("SELECT * FROM lots WHERE id = ?").WithArgs(int64(7)).WillReturnRows(&want)
+
+	var got fakeLot
+	if err := fake.GetContext(context.Background(), &got, "SELECT * FROM lots WHERE id = ?", 7); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Get row = %+v, want %+v", got, want)
+	}
+}
+
+func TestFakeDB_WithArgsMismatch(t *testing.T) {
+
+	fake := NewFakeDB()
+	defer fake.Close()
+
+	fake.ExpectExec("UPDATE lots SET capacity = ? WHERE id = ?").WithArgs(100, 1)
+
+	_, err := fake.Exec("UPDATE lots SET capacity = ? WHERE id = ?", 100, 2)
+	if err == nil || !strings.Contains(err.Error(), "expected") {
+		t.Fatalf("Exec with wrong args: err = %v, want args mismatch", err)
+	}
+
+	err = fake.ExpectationsWereMet()
+	if err == nil {
+		t.Fatal("ExpectationsWereMet = nil after an args mismatch")
+	}
+	if !strings.Contains(err.Error(), "called with args") || !strings.Contains(err.Error(), "was not called") {
+		t.Fatalf("ExpectationsWereMet = %v, want the mismatch and the unmet expectation", err)
+	}
+}
+
+func TestFakeDB_UnexpectedCall(t *testing.T) {
+
+	fake := NewFakeDB()
+	defer fake.Close()
+
+	fake.ExpectQuery("SELECT * FROM lots")
+
+	if _, err := fake.Exec("DELETE FROM lots"); err == nil {
+		t.Fatal("Exec while a query is expected: err = nil")
+	}
+
+	if err := fake.ExpectationsWereMet(); err == nil || !strings.Contains(err.Error(), "DELETE FROM lots") {
+		t.Fatalf("ExpectationsWereMet = %v, want the unexpected exec reported", err)
+	}
+}
+
+func TestFakeDB_InjectedErrors(t *testing.T) {
+
+	fake := NewFakeDB()
+	defer fake.Close()
+
+	errDeadlock := errors.New("deadlock")
+	errGone := errors.New("server gone")
+
+	fake.ExpectExec("INSERT INTO lots (name) VALUES (?)").WillReturnError(errDeadlock)
+	fake.ExpectQuery("SELECT * FROM lots").WillReturnError(errGone)
+
+	if _, err := fake.Exec("INSERT INTO lots (name) VALUES (?)", "west"); err != errDeadlock {
+		t.Fatalf("Exec err = %v, want %v", err, errDeadlock)
+	}
+
+	var lots []fakeLot
+	if err := fake.Select(&lots, "SELECT * FROM lots"); err != errGone {
+		t.Fatalf("Select err = %v, want %v", err, errGone)
+	}
+
+	// an injected error is an expectation met, not a failure
+	if err := fake.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFakeDB_Transaction(t *testing.T) {
+
+	fake := NewFakeDB()
+	defer fake.Close()
+
+	fake.ExpectBegin()
+	fake.ExpectExec("UPDATE lots SET capacity = capacity - 1 WHERE id = ?").WithArgs(3).WillReturnResult(0, 1)
+	fake.ExpectCommit()
+	fake.ExpectBegin()
+	fake.ExpectExec("DELETE FROM lots").WillReturnError(errors.New("locked"))
+	fake.ExpectRollback()
+
+	tx, err := fake.Begin()
+	if err != nil {
+		t.Fatalf("Begin: %v", err)
+	}
+	result, err := tx.Exec("UPDATE lots SET capacity = capacity - 1 WHERE id = ?", 3)
+	if err != nil {
+		t.Fatalf("Exec: %v", err)
+	}
+	if n, _ := result.RowsAffected(); n != 1 {
+		t.Fatalf("RowsAffected = %d, want 1", n)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+
+	tx, err = fake.BeginTx(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("BeginTx: %v", err)
+	}
+	if _, err := tx.Exec("DELETE FROM lots"); err == nil {
+		t.Fatal("Exec err = nil, want injected error")
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatalf("Rollback: %v", err)
+	}
+
+	if err := fake.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFakeDB_UnmetExpectations(t *testing.T) {
+
+	fake := NewFakeDB()
+	defer fake.Close()
+
+	fake.ExpectExec("INSERT INTO lots (name) VALUES (?)")
+	fake.ExpectExec("INSERT INTO zones (name) VALUES (?)")
+
+	if _, err := fake.Exec("INSERT INTO lots (name) VALUES (?)", "north"); err != nil {
+		t.Fatalf("Exec: %v", err)
+	}
+
+	err := fake.ExpectationsWereMet()
+	if err == nil {
+		t.Fatal("ExpectationsWereMet = nil with an expectation left")
+	}
+	if !strings.Contains(err.Error(), "INSERT INTO zones") || strings.Contains(err.Error(), "INSERT INTO lots") {
+		t.Fatalf("ExpectationsWereMet = %v, want only the zones insert reported", err)
+	}
+}
@@ -0,0 +1,253 @@
+package DB
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+var (
+	// ErrDB_SlaveNotConnected ...
+	ErrDB_SlaveNotConnected = errors.New("DB: slave is not connected")
+	// ErrDB_ReplicationStopped ...
+	ErrDB_ReplicationStopped = errors.New("DB: replication is not running")
+)
+
+// DBNodeState health of a slave as seen by the last probe
+type DBNodeState struct {
+	Host      string
+	Healthy   bool
+	Lag       time.Duration
+	LastError error
+	CheckedAt time.Time
+}
+
+type dbNode struct {
+	db    *sqlx.DB
+	state DBNodeState
+	lock  sync.RWMutex
+}
+
+func (this *dbNode) isHealthy() bool {
+
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	return this.state.Healthy
+}
+
+func (this *dbNode) State() DBNodeState {
+
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	return this.state
+}
+
+// dbHealth background checker which keeps lagging or broken slaves out of read rotation
+type dbHealth struct {
+	dbType   string
+	nodes    []*dbNode
+	maxLag   time.Duration
+	interval time.Duration
+	next     uint32
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func newDBHealth(c *DBConfig, hosts []string, slaves []*sqlx.DB) *dbHealth {
+
+	health := &dbHealth{
+		dbType:   c.Type,
+		nodes:    make([]*dbNode, len(slaves)),
+		maxLag:   time.Duration(c.SlaveMaxLagInSecond) * time.Second,
+		interval: time.Duration(c.HealthCheckIntervalInSecond) * time.Second,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	for i := range slaves {
+		host := strconv.Itoa(i)
+		if i < len(hosts) {
+			host = hosts[i]
+		}
+
+		// slaves start in rotation until the first probe says otherwise
+		health.nodes[i] = &dbNode{
+			db:    slaves[i],
+			state: DBNodeState{Host: host, Healthy: slaves[i] != nil},
+		}
+	}
+
+	return health
+}
+
+func (this *dbHealth) start() {
+
+	go func() {
+
+		defer close(this.done)
+
+		ticker := time.NewTicker(this.interval)
+		defer ticker.Stop()
+
+		this.checkAll()
+		for {
+			select {
+			case <-this.stop:
+				return
+			case <-ticker.C:
+				this.checkAll()
+			}
+		}
+	}()
+}
+
+func (this *dbHealth) close() {
+	close(this.stop)
+	<-this.done
+}
+
+func (this *dbHealth) checkAll() {
+
+	var wg sync.WaitGroup
+	for _, node := range this.nodes {
+		wg.Add(1)
+		go func(node *dbNode) {
+			defer wg.Done()
+			this.check(node)
+		}(node)
+	}
+	wg.Wait()
+}
+
+func (this *dbHealth) check(node *dbNode) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), this.interval)
+	defer cancel()
+
+	lag, err := this.probe(ctx, node.db)
+
+	node.lock.Lock()
+	defer node.lock.Unlock()
+
+	node.state.Lag = lag
+	node.state.LastError = err
+	node.state.CheckedAt = time.Now()
+	node.state.Healthy = err == nil && (this.maxLag <= 0 || lag <= this.maxLag)
+}
+
+// probe ping slave and read its replication lag
+func (this *dbHealth) probe(ctx context.Context, db *sqlx.DB) (time.Duration, error) {
+
+	if db == nil {
+		return 0, ErrDB_SlaveNotConnected
+	}
+
+	if err := db.PingContext(ctx); err != nil {
+		return 0, err
+	}
+
+	if this.dbType == DBType_Postgres {
+		// a standby which replayed everything it received is caught up, however old its last
+		// replayed transaction is: an idle master writes nothing to replay
+		var seconds sql.NullFloat64
+		err := db.GetContext(ctx, &seconds, `SELECT CASE
+			WHEN pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0
+			ELSE EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()) END`)
+		if err != nil {
+			return 0, err
+		}
+		// NULL: server is not replaying, ie. not a standby
+		return time.Duration(seconds.Float64 * float64(time.Second)), nil
+	}
+
+	rows, err := db.QueryxContext(ctx, "SHOW SLAVE STATUS")
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return 0, err
+		}
+		// not configured as a slave
+		return 0, nil
+	}
+
+	status := make(map[string]interface{})
+	if err := rows.MapScan(status); err != nil {
+		return 0, err
+	}
+
+	var seconds string
+	switch v := status["Seconds_Behind_Master"].(type) {
+	case []byte:
+		seconds = string(v)
+	case string:
+		seconds = v
+	case int64:
+		seconds = strconv.FormatInt(v, 10)
+	default:
+		return 0, ErrDB_ReplicationStopped
+	}
+
+	n, err := strconv.ParseInt(seconds, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	return time.Duration(n) * time.Second, nil
+}
+
+// pick next healthy slave round robin, nil when none is healthy
+func (this *dbHealth) pick() *sqlx.DB {
+
+	n := len(this.nodes)
+	if n == 0 {
+		return nil
+	}
+
+	start := int(atomic.AddUint32(&this.next, 1) % uint32(n))
+	for i := 0; i < n; i++ {
+		node := this.nodes[(start+i)%n]
+		if node.isHealthy() {
+			return node.db
+		}
+	}
+
+	return nil
+}
+
+func (this *dbHealth) states() []DBNodeState {
+
+	states := make([]DBNodeState, len(this.nodes))
+	for i, node := range this.nodes {
+		states[i] = node.State()
+	}
+
+	return states
+}
+
+// SlaveStates health of every slave from the last probe, nil when health check is disabled
+func (this *DBInstance) SlaveStates() []DBNodeState {
+
+	pool, err := this.acquire()
+	if err != nil {
+		return nil
+	}
+	defer pool.release()
+
+	if pool.health == nil {
+		return nil
+	}
+
+	return pool.health.states()
+}
@@ -1,28 +1,80 @@
 package DB
 
 import (
-	"crypto/tls"
-	"crypto/x509"
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
-	"io/ioutil"
-	Const "iparking/share/const"
+	"net/url"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"
 	"github.com/linxGnu/mssqlx"
 )
 
+const (
+	DBType_MySQL    = "mysql"
+	DBType_Postgres = "postgres"
+)
+
+var (
+	// ErrDB_UnsupportedType ...
+	ErrDB_UnsupportedType = errors.New("DB: only mysql and postgres are supported")
+	// ErrDB_NoMaster ...
+	ErrDB_NoMaster = errors.New("DB: no master available")
+	// ErrDB_NotConnected ...
+	ErrDB_NotConnected = errors.New("DB: not connected")
+)
+
 type DBInstance struct {
-	db *mssqlx.DBs
+	pool    *dbPool
+	metrics DBMetrics
+	lock    sync.RWMutex
+}
+
+// dbReader common read surface of mssqlx.DBs and a single sqlx.DB
+type dbReader interface {
+	SelectContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error
+	GetContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error
+	QueryxContext(ctx context.Context, query string, args ...interface{}) (*sqlx.Rows, error)
 }
 
 func (this *DBInstance) Configure(c *DBConfig) error {
 
-	if c.Type != "mysql" {
-		return Const.ErrDB_MysqlOnly
+	switch c.Type {
+	case DBType_MySQL:
+		if err := this.configureMySQL(c); err != nil {
+			return err
+		}
+	case DBType_Postgres:
+		if err := this.configurePostgres(c); err != nil {
+			return err
+		}
+	default:
+		return ErrDB_UnsupportedType
+	}
+
+	if c.Master != nil && len(c.Master) > 0 {
+		for i := range c.Master {
+			c.Master[i] = this.dsn(c, c.Master[i])
+		}
 	}
 
+	if c.Slaves != nil && len(c.Slaves) > 0 {
+		for i := range c.Slaves {
+			c.Slaves[i] = this.dsn(c, c.Slaves[i])
+		}
+	}
+
+	return nil
+}
+
+func (this *DBInstance) configureMySQL(c *DBConfig) error {
+
 	if len(c.Tls) > 0 {
 		if strings.HasSuffix(c.Args, "&") {
 			c.Args += "tls=" + c.Tls
@@ -30,91 +82,288 @@ func (this *DBInstance) Configure(c *DBConfig) error {
 			c.Args += "&tls=" + c.Tls
 		}
 
-		rootCertPool := x509.NewCertPool()
-		pem, err := ioutil.ReadFile(c.CaCert)
+		// true, false, skip-verify and preferred are handled by the driver itself and cannot be registered
+		if mysqlReservedTls(c.Tls) {
+			return nil
+		}
+
+		tlsConfig, err := c.TLSConfig()
 		if err != nil {
 			return err
 		}
-		if ok := rootCertPool.AppendCertsFromPEM(pem); !ok {
-			return Const.ErrDB_FailedAppendPEM
+
+		if err := mysql.RegisterTLSConfig(c.Tls, tlsConfig); err != nil {
+			return err
 		}
+	}
 
-		// clientCert := make([]tls.Certificate, 0, 1)
-		// certs, err := tls.LoadX509KeyPair(c.ClientCert, c.ClientKey)
-		// if err != nil {
-		// 	return err
-		// }
-		// clientCert = append(clientCert, certs)
-
-		mysql.RegisterTLSConfig(c.Tls, &tls.Config{
-			RootCAs: rootCertPool,
-			// Certificates:             clientCert,
-			MinVersion:               tls.VersionTLS12,
-			CurvePreferences:         []tls.CurveID{tls.CurveP521, tls.CurveP384, tls.CurveP256},
-			PreferServerCipherSuites: false,
-			CipherSuites: []uint16{
-				tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
-				tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
-				tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
-				tls.TLS_RSA_WITH_AES_256_CBC_SHA,
-			},
-			InsecureSkipVerify: true,
-		})
+	return nil
+}
+
+// mysqlReservedTls whether name is a tls value of go-sql-driver/mysql rather than a registered config
+func mysqlReservedTls(name string) bool {
+
+	switch name {
+	case "1", "true", "TRUE", "True", "0", "false", "FALSE", "False":
+		return true
 	}
 
-	if c.Master != nil && len(c.Master) > 0 {
-		for i := range c.Master {
-			c.Master[i] = fmt.Sprintf("%s:%s@(%s)/%s?%s", c.Username, c.Password, c.Master[i], c.DB, c.Args)
+	lower := strings.ToLower(name)
+	return lower == "skip-verify" || lower == "preferred"
+}
+
+// configurePostgres translate Tls, TlsMode, CaCert, ClientCert, ClientKey into lib/pq ssl args.
+// Tls may be one of the libpq sslmode values, any other non-empty value means TlsMode.
+// lib/pq does its own handshake so TlsMinVersion and TlsCipherPolicy do not apply
+func (this *DBInstance) configurePostgres(c *DBConfig) error {
+
+	args, err := url.ParseQuery(c.Args)
+	if err != nil {
+		return err
+	}
+
+	if len(c.Tls) == 0 {
+		if args.Get("sslmode") == "" {
+			args.Set("sslmode", "disable")
 		}
+		c.Args = args.Encode()
+		return nil
 	}
 
-	if c.Slaves != nil && len(c.Slaves) > 0 {
-		for i := range c.Slaves {
-			c.Slaves[i] = fmt.Sprintf("%s:%s@(%s)/%s?%s", c.Username, c.Password, c.Slaves[i], c.DB, c.Args)
+	switch c.Tls {
+	case "disable", "require", TlsMode_VerifyCA, TlsMode_VerifyFull:
+		args.Set("sslmode", c.Tls)
+	default:
+		switch c.tlsMode() {
+		case TlsMode_VerifyCA, TlsMode_VerifyFull:
+			args.Set("sslmode", c.tlsMode())
+		default:
+			return ErrDB_InvalidTlsMode
 		}
 	}
 
+	if len(c.CaCert) > 0 {
+		args.Set("sslrootcert", c.CaCert)
+	}
+
+	if len(c.ClientCert) > 0 && len(c.ClientKey) > 0 {
+		args.Set("sslcert", c.ClientCert)
+		args.Set("sslkey", c.ClientKey)
+	}
+
+	c.Args = args.Encode()
 	return nil
 }
 
+// dsn build driver specific data source name for host
+func (this *DBInstance) dsn(c *DBConfig, host string) string {
+
+	if c.Type == DBType_Postgres {
+		u := url.URL{
+			Scheme:   "postgres",
+			User:     url.UserPassword(c.Username, c.Password),
+			Host:     host,
+			Path:     "/" + c.DB,
+			RawQuery: c.Args,
+		}
+		return u.String()
+	}
+
+	return fmt.Sprintf("%s:%s@(%s)/%s?%s", c.Username, c.Password, host, c.DB, c.Args)
+}
+
+// Connect build a new pool from c and swap it in. The previous pool, if any, stops taking
+// queries immediately and is destroyed once its in-flight queries finish (or DrainTimeoutInSecond passes).
+// Use it for password rotation, slave changes and pool size changes. c is not modified
 func (this *DBInstance) Connect(c *DBConfig) error {
 
-	if err := this.Configure(c); err != nil {
+	conf := *c
+	conf.Master = append([]string{}, c.Master...)
+	conf.Slaves = append([]string{}, c.Slaves...)
+
+	masterHosts := append([]string{}, c.Master...)
+	slaveHosts := append([]string{}, c.Slaves...)
+
+	if err := this.Configure(&conf); err != nil {
 		return err
 	}
 
-	_db, errors := mssqlx.ConnectMasterSlaves(c.Type, c.Master, c.Slaves)
+	_db, errors := mssqlx.ConnectMasterSlaves(conf.Type, conf.Master, conf.Slaves)
 	if _db == nil {
 		return fmt.Errorf("Connection to DB Fail %v", errors)
 	}
 
-	if this.db != nil {
-		this.db.Destroy()
-	}
+	this.lock.Lock()
+	pool := newDBPool(_db, &conf, masterHosts, slaveHosts, this.metrics)
+	old := this.pool
+	this.pool = pool
+	this.lock.Unlock()
 
-	this.db = _db
-	this.db.SetMaxIdleConns(c.MaxIdleConn)
-	this.db.SetMaxOpenConns(c.MaxOpenConn)
+	if old != nil {
+		go old.drain()
+	}
 
 	return nil
 }
 
+// Close stop taking queries and destroy the pool once in-flight queries finish
+func (this *DBInstance) Close() {
+
+	this.lock.Lock()
+	old := this.pool
+	this.pool = nil
+	this.lock.Unlock()
+
+	if old != nil {
+		old.drain()
+	}
+}
+
+// acquire current pool, the caller must release it when the query is done
+func (this *DBInstance) acquire() (*dbPool, error) {
+
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	if this.pool == nil {
+		return nil, ErrDB_NotConnected
+	}
+
+	this.pool.inflight.Add(1)
+	return this.pool, nil
+}
+
 func (this *DBInstance) Begin() (*sql.Tx, error) {
-	return this.db.Begin()
+	return this.BeginTx(context.Background(), nil)
+}
+
+// BeginTx start transaction on master, the transaction is rolled back when ctx is done.
+// The transaction is not tracked by pool draining, prefer WithTx.
+//
+// A read-write transaction marks the read-your-writes session of ctx as written when it begins, since
+// its commit cannot be observed: the sticky window runs from Begin and GTID tracking is not used, so a
+// transaction longer than the window should go through WithTx. Begin has no context, hence no session
+func (this *DBInstance) BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error) {
+
+	pool, err := this.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer pool.release()
+
+	start := time.Now()
+	tx, err := pool.db.BeginTx(ctx, opts)
+	pool.observe(DBRole_Master, DBOp_Begin, "", start, err)
+	if err == nil && (opts == nil || !opts.ReadOnly) {
+		pool.markTxBegin(ctx)
+	}
+
+	return tx, err
 }
 
 func (this *DBInstance) Exec(query string, args ...interface{}) (sql.Result, error) {
-	return this.db.Exec(query, args...)
+	return this.ExecContext(context.Background(), query, args...)
+}
+
+// ExecContext exec query on master
+func (this *DBInstance) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+
+	pool, err := this.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer pool.release()
+
+	ctx, cancel := pool.withTimeout(ctx)
+	defer cancel()
+
+	start := time.Now()
+	result, err := pool.db.ExecContext(ctx, query, args...)
+	pool.observe(DBRole_Master, DBOp_Exec, query, start, err)
+	if err == nil {
+		pool.markWrite(ctx)
+	}
+
+	return result, err
 }
 
 func (this *DBInstance) Select(dest interface{}, query string, args ...interface{}) error {
-	return this.db.Select(dest, query, args...)
+	return this.SelectContext(context.Background(), dest, query, args...)
+}
+
+// SelectContext select rows from slaves (or master when no slave is available)
+func (this *DBInstance) SelectContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+
+	pool, err := this.acquire()
+	if err != nil {
+		return err
+	}
+	defer pool.release()
+
+	ctx, cancel := pool.withTimeout(ctx)
+	defer cancel()
+
+	reader, role := pool.reader(ctx)
+
+	start := time.Now()
+	err = reader.SelectContext(ctx, dest, query, args...)
+	pool.observe(role, DBOp_Select, query, start, err)
+
+	return err
 }
 
 func (this *DBInstance) Get(dest interface{}, query string, args ...interface{}) error {
-	return this.db.Get(dest, query, args...)
+	return this.GetContext(context.Background(), dest, query, args...)
+}
+
+// GetContext get single row from slaves (or master when no slave is available)
+func (this *DBInstance) GetContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+
+	pool, err := this.acquire()
+	if err != nil {
+		return err
+	}
+	defer pool.release()
+
+	ctx, cancel := pool.withTimeout(ctx)
+	defer cancel()
+
+	reader, role := pool.reader(ctx)
+
+	start := time.Now()
+	err = reader.GetContext(ctx, dest, query, args...)
+	pool.observe(role, DBOp_Get, query, start, err)
+
+	return err
 }
 
+// Instance current mssqlx pool, nil when not connected. It may be drained by a later Connect
 func (this *DBInstance) Instance() *mssqlx.DBs {
-	return this.db
+
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	if this.pool == nil {
+		return nil
+	}
+
+	return this.pool.db
+}
+
+// Type dialect of the current pool, mysql or postgres
+func (this *DBInstance) Type() string {
+	return this.dbType()
+}
+
+// dbType dialect of the current pool
+func (this *DBInstance) dbType() string {
+
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	if this.pool == nil {
+		return ""
+	}
+
+	return this.pool.dbType
 }
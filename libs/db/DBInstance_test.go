@@ -0,0 +1,36 @@
+package DB
+
+import (
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+func TestDBInstance_ConfigureMySQLReservedTls(t *testing.T) {
+
+	for _, name := range []string{"true", "false", "skip-verify", "preferred", "1"} {
+		c := &DBConfig{Type: DBType_MySQL, DB: "app", Username: "u", Password: "p", Master: []string{"db:3306"}, Tls: name}
+
+		instance := &DBInstance{}
+		if err := instance.Configure(c); err != nil {
+			t.Fatalf("Configure tls=%s: %v", name, err)
+		}
+
+		dsn, err := mysql.ParseDSN(c.Master[0])
+		if err != nil {
+			t.Fatalf("ParseDSN %s: %v", c.Master[0], err)
+		}
+		if dsn.TLSConfig == "" {
+			t.Fatalf("tls=%s dropped from dsn %s", name, c.Master[0])
+		}
+	}
+}
+
+func TestDBInstance_ConfigureMySQLCustomTls(t *testing.T) {
+
+	c := &DBConfig{Type: DBType_MySQL, DB: "app", Master: []string{"db:3306"}, Tls: "custom", CaCert: "/nonexistent/ca.pem"}
+
+	if err := (&DBInstance{}).Configure(c); err == nil {
+		t.Fatal("Configure with a custom tls name and unreadable CaCert succeeded")
+	}
+}
@@ -0,0 +1,132 @@
+package DB
+
+import (
+	"database/sql"
+	"fmt"
+	Logger "iparking/share/libs/logger"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	defaultMetricsInterval = 15 * time.Second
+
+	DBRole_Master = "master"
+	DBRole_Slave  = "slave"
+
+	DBOp_Exec   = "exec"
+	DBOp_Select = "select"
+	DBOp_Get    = "get"
+	DBOp_Begin  = "begin"
+	DBOp_Tx     = "tx"
+)
+
+// DBMetrics receive query and pool measurements of a DBInstance, see PrometheusMetrics
+type DBMetrics interface {
+	// ObserveQuery latency of one call, err is nil on success (sql.ErrNoRows counts as success)
+	ObserveQuery(role, op string, duration time.Duration, err error)
+	// ObserveSlowQuery a call over DBConfig.SlowQueryInMillisecond with its SQL fingerprint
+	ObserveSlowQuery(role, op, fingerprint string, duration time.Duration)
+	// ObservePool periodic connection pool stats of one node
+	ObservePool(role, node string, stats sql.DBStats)
+}
+
+var (
+	fpString     = regexp.MustCompile(`'(?:[^'\\]|\\.|'')*'|"(?:[^"\\]|\\.)*"`)
+	fpNumber     = regexp.MustCompile(`\b-?\d+(?:\.\d+)?\b`)
+	fpBindvar    = regexp.MustCompile(`\$\d+`)
+	fpList       = regexp.MustCompile(`\(\s*\?(?:\s*,\s*\?)+\s*\)`)
+	fpWhitespace = regexp.MustCompile(`\s+`)
+)
+
+// SetMetrics plug metrics in, must be called before Connect
+func (this *DBInstance) SetMetrics(metrics DBMetrics) {
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.metrics = metrics
+}
+
+// Fingerprint normalize query so that calls differing only by literal values group together
+func Fingerprint(query string) string {
+
+	fp := fpString.ReplaceAllString(query, "?")
+	fp = fpBindvar.ReplaceAllString(fp, "?")
+	fp = fpNumber.ReplaceAllString(fp, "?")
+	fp = fpList.ReplaceAllString(fp, "(?+)")
+	fp = fpWhitespace.ReplaceAllString(fp, " ")
+
+	return strings.ToLower(strings.TrimSpace(fp))
+}
+
+// observe report a finished call to metrics and the slow query log
+func (this *dbPool) observe(role, op, query string, start time.Time, err error) {
+
+	duration := time.Since(start)
+
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+
+	if this.metrics != nil {
+		this.metrics.ObserveQuery(role, op, duration, err)
+	}
+
+	if this.slowQuery <= 0 || duration < this.slowQuery || len(query) == 0 {
+		return
+	}
+
+	fingerprint := Fingerprint(query)
+	if this.metrics != nil {
+		this.metrics.ObserveSlowQuery(role, op, fingerprint, duration)
+	}
+
+	message := fmt.Sprintf("slow query;;%s;;%s;;%v;;%s", role, op, duration, fingerprint)
+	if logger := Logger.GetGlobalLogger(); logger != nil {
+		logger.InfoLog(message)
+	} else {
+		Logger.WriteLog(message)
+	}
+}
+
+// reportPool push stats of every node to metrics until the pool is drained
+func (this *dbPool) reportPool(interval time.Duration) {
+
+	defer close(this.metricsDone)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-this.metricsStop:
+			return
+		case <-ticker.C:
+		}
+
+		masters, _ := this.db.GetAllMasters()
+		for i, master := range masters {
+			if master != nil {
+				this.metrics.ObservePool(DBRole_Master, nodeName(this.masterHosts, i), master.Stats())
+			}
+		}
+
+		slaves, _ := this.db.GetAllSlaves()
+		for i, slave := range slaves {
+			if slave != nil {
+				this.metrics.ObservePool(DBRole_Slave, nodeName(this.slaveHosts, i), slave.Stats())
+			}
+		}
+	}
+}
+
+func nodeName(hosts []string, i int) string {
+
+	if i < len(hosts) {
+		return hosts[i]
+	}
+
+	return fmt.Sprintf("#%d", i)
+}
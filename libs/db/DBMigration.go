@@ -0,0 +1,524 @@
+package DB
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultMigrationTable       = "schema_migrations"
+	defaultMigrationLockTimeout = 60
+
+	// GET_LOCK names are server wide and limited to 64 characters: scope the name to the database so
+	// services sharing a server do not serialize each other, and hash it to fit
+	mysqlMigrationLock = "SHA1(CONCAT(IFNULL(DATABASE(), ''), '.', ?))"
+)
+
+var (
+	// ErrDB_MigrationLocked ...
+	ErrDB_MigrationLocked = errors.New("DB: another instance is migrating")
+	// ErrDB_MigrationNoDown ...
+	ErrDB_MigrationNoDown = errors.New("DB: migration has no down script")
+	// ErrDB_MigrationDuplicated ...
+	ErrDB_MigrationDuplicated = errors.New("DB: duplicated migration version")
+	// ErrDB_InvalidMigrationTable ...
+	ErrDB_InvalidMigrationTable = errors.New("DB: invalid migration table name")
+
+	// <version>_<name>.up.sql or <version>_<name>.down.sql
+	migrationFile  = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+	migrationTable = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// Migration versioned up/down SQL scripts
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+// MigrationStatus migration with its applied state
+type MigrationStatus struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// Migrator apply migrations to master of DB, one instance at a time
+type Migrator struct {
+	DB         *DBInstance
+	Migrations []Migration
+
+	// table recording applied versions, default schema_migrations
+	Table string
+
+	// seconds to wait for the advisory lock, default 60
+	LockTimeoutInSecond int
+
+	// report migrations that would run without executing them or creating Table
+	DryRun bool
+}
+
+// NewMigrator load migrations from dir of fsys, use os.DirFS for a directory or an embed.FS
+func NewMigrator(db *DBInstance, fsys fs.FS, dir string) (*Migrator, error) {
+
+	migrations, err := LoadMigrations(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Migrator{DB: db, Migrations: migrations}, nil
+}
+
+// LoadMigrations read <version>_<name>.up.sql / .down.sql files of dir, sorted by version
+func LoadMigrations(fsys fs.FS, dir string) ([]Migration, error) {
+
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int64]*Migration)
+	prefixes := make(map[int64]string)
+	for _, entry := range entries {
+
+		if entry.IsDir() {
+			continue
+		}
+
+		m := migrationFile.FindStringSubmatch(entry.Name())
+		if m == nil {
+			continue
+		}
+
+		version, err := strconv.ParseInt(m[1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+
+		content, err := fs.ReadFile(fsys, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		// 001_x and 1_x are the same version, only the up and down files of one prefix may share it
+		prefix := m[1] + "_" + m[2]
+		migration, ok := byVersion[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: m[2]}
+			byVersion[version] = migration
+			prefixes[version] = prefix
+		} else if prefixes[version] != prefix {
+			return nil, fmt.Errorf("%w: %d (%s, %s)", ErrDB_MigrationDuplicated, version, prefixes[version], prefix)
+		}
+
+		if m[3] == "up" {
+			migration.Up = string(content)
+		} else {
+			migration.Down = string(content)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		migrations = append(migrations, *migration)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations, nil
+}
+
+func (this *Migrator) table() (string, error) {
+
+	table := this.Table
+	if len(table) == 0 {
+		table = defaultMigrationTable
+	}
+
+	if !migrationTable.MatchString(table) {
+		return "", ErrDB_InvalidMigrationTable
+	}
+
+	return table, nil
+}
+
+func (this *Migrator) isPostgres() bool {
+	return this.DB.dbType() == DBType_Postgres
+}
+
+// bind rewrite ? placeholders for postgres
+func (this *Migrator) bind(query string) string {
+
+	if !this.isPostgres() {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+
+	return b.String()
+}
+
+// Up apply every pending migration in version order, return the applied (or, on dry run, pending) ones
+func (this *Migrator) Up(ctx context.Context) ([]Migration, error) {
+
+	var done []Migration
+	err := this.withLock(ctx, func(conn *sql.Conn, table string, applied map[int64]time.Time) error {
+
+		for _, migration := range this.Migrations {
+
+			if _, ok := applied[migration.Version]; ok {
+				continue
+			}
+
+			if !this.DryRun {
+				err := this.run(ctx, conn, migration.Up,
+					this.bind("INSERT INTO "+table+" (version, name) VALUES (?, ?)"), migration.Version, migration.Name)
+				if err != nil {
+					return fmt.Errorf("migrate up %d_%s: %v", migration.Version, migration.Name, err)
+				}
+			}
+
+			done = append(done, migration)
+		}
+
+		return nil
+	})
+
+	return done, err
+}
+
+// DownTo roll back applied migrations newer than version, newest first.
+// Return the rolled back (or, on dry run, to be rolled back) ones
+func (this *Migrator) DownTo(ctx context.Context, version int64) ([]Migration, error) {
+
+	var done []Migration
+	err := this.withLock(ctx, func(conn *sql.Conn, table string, applied map[int64]time.Time) error {
+
+		for i := len(this.Migrations) - 1; i >= 0; i-- {
+
+			migration := this.Migrations[i]
+			if migration.Version <= version {
+				break
+			}
+
+			if _, ok := applied[migration.Version]; !ok {
+				continue
+			}
+
+			if len(strings.TrimSpace(migration.Down)) == 0 {
+				return fmt.Errorf("%w: %d_%s", ErrDB_MigrationNoDown, migration.Version, migration.Name)
+			}
+
+			if !this.DryRun {
+				err := this.run(ctx, conn, migration.Down,
+					this.bind("DELETE FROM "+table+" WHERE version = ?"), migration.Version)
+				if err != nil {
+					return fmt.Errorf("migrate down %d_%s: %v", migration.Version, migration.Name, err)
+				}
+			}
+
+			done = append(done, migration)
+		}
+
+		return nil
+	})
+
+	return done, err
+}
+
+// Status every known migration with its applied state. It never creates the migration table
+func (this *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+
+	table, err := this.table()
+	if err != nil {
+		return nil, err
+	}
+
+	pool, err := this.DB.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer pool.release()
+
+	master, _ := pool.db.GetMaster()
+	if master == nil {
+		return nil, ErrDB_NoMaster
+	}
+
+	conn, err := master.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	applied, err := this.loadApplied(ctx, conn, table, false)
+	if err != nil {
+		return nil, err
+	}
+
+	status := make([]MigrationStatus, len(this.Migrations))
+	for i, migration := range this.Migrations {
+		status[i].Migration = migration
+		status[i].AppliedAt, status[i].Applied = applied[migration.Version]
+	}
+
+	return status, nil
+}
+
+// withLock run fn with the applied versions on a single master connection holding the migration
+// advisory lock. The migration table is created unless DryRun is set
+func (this *Migrator) withLock(ctx context.Context, fn func(conn *sql.Conn, table string, applied map[int64]time.Time) error) error {
+
+	table, err := this.table()
+	if err != nil {
+		return err
+	}
+
+	pool, err := this.DB.acquire()
+	if err != nil {
+		return err
+	}
+	defer pool.release()
+
+	master, _ := pool.db.GetMaster()
+	if master == nil {
+		return ErrDB_NoMaster
+	}
+
+	conn, err := master.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	timeout := this.LockTimeoutInSecond
+	if timeout <= 0 {
+		timeout = defaultMigrationLockTimeout
+	}
+
+	if this.isPostgres() {
+		key := lockKey(table)
+		lockCtx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+		_, err := conn.ExecContext(lockCtx, "SELECT pg_advisory_lock($1)", key)
+		cancel()
+		if err != nil {
+			if lockCtx.Err() == context.DeadlineExceeded {
+				return ErrDB_MigrationLocked
+			}
+			return err
+		}
+		defer conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", key)
+	} else {
+		var locked sql.NullInt64
+		if err := conn.QueryRowContext(ctx, "SELECT GET_LOCK("+mysqlMigrationLock+", ?)", table, timeout).Scan(&locked); err != nil {
+			return err
+		}
+		if !locked.Valid || locked.Int64 != 1 {
+			return ErrDB_MigrationLocked
+		}
+		defer conn.ExecContext(context.Background(), "SELECT RELEASE_LOCK("+mysqlMigrationLock+")", table)
+	}
+
+	applied, err := this.loadApplied(ctx, conn, table, !this.DryRun)
+	if err != nil {
+		return err
+	}
+
+	return fn(conn, table, applied)
+}
+
+// loadApplied applied versions of table. Without create the table is left untouched and a missing
+// table means nothing was applied
+func (this *Migrator) loadApplied(ctx context.Context, conn *sql.Conn, table string, create bool) (map[int64]time.Time, error) {
+
+	if create {
+		if err := this.ensureTable(ctx, conn, table); err != nil {
+			return nil, err
+		}
+		return this.applied(ctx, conn, table)
+	}
+
+	var exists bool
+	query := "SELECT COUNT(*) > 0 FROM information_schema.tables WHERE table_schema = DATABASE() AND table_name = ?"
+	if this.isPostgres() {
+		query = "SELECT to_regclass($1) IS NOT NULL"
+	}
+
+	if err := conn.QueryRowContext(ctx, query, table).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if !exists {
+		return make(map[int64]time.Time), nil
+	}
+
+	return this.applied(ctx, conn, table)
+}
+
+func (this *Migrator) ensureTable(ctx context.Context, conn *sql.Conn, table string) error {
+
+	_, err := conn.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS "+table+" ("+
+		"version BIGINT NOT NULL PRIMARY KEY, "+
+		"name VARCHAR(255) NOT NULL, "+
+		"applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP)")
+	return err
+}
+
+func (this *Migrator) applied(ctx context.Context, conn *sql.Conn, table string) (map[int64]time.Time, error) {
+
+	rows, err := conn.QueryContext(ctx, "SELECT version, applied_at FROM "+table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int64]time.Time)
+	for rows.Next() {
+		var version int64
+		var appliedAt interface{}
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = parseAppliedAt(appliedAt)
+	}
+
+	return applied, rows.Err()
+}
+
+// run execute script statements and the bookkeeping query in one transaction.
+// Note that mysql commits DDL implicitly, so a failed mysql script may be half applied
+func (this *Migrator) run(ctx context.Context, conn *sql.Conn, script string, record string, args ...interface{}) error {
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	for _, stmt := range SplitStatements(script) {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, record, args...); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// SplitStatements split a script on semicolons outside of quotes and comments.
+// Postgres dollar quoting and mysql DELIMITER are not understood
+func SplitStatements(script string) []string {
+
+	var stmts []string
+	var b strings.Builder
+	var quote rune
+	lineComment, blockComment := false, false
+
+	runes := []rune(script)
+	for i := 0; i < len(runes); i++ {
+
+		r := runes[i]
+		next := rune(0)
+		if i+1 < len(runes) {
+			next = runes[i+1]
+		}
+
+		switch {
+		case lineComment:
+			if r == '\n' {
+				lineComment = false
+				b.WriteRune(r)
+			}
+			continue
+		case blockComment:
+			if r == '*' && next == '/' {
+				blockComment = false
+				i++
+			}
+			continue
+		case quote != 0:
+			b.WriteRune(r)
+			if r == '\\' && quote != '`' && next != 0 {
+				b.WriteRune(next)
+				i++
+			} else if r == quote {
+				quote = 0
+			}
+			continue
+		}
+
+		switch {
+		case r == '-' && next == '-':
+			lineComment = true
+		case r == '/' && next == '*':
+			blockComment = true
+			i++
+		case r == '\'' || r == '"' || r == '`':
+			quote = r
+			b.WriteRune(r)
+		case r == ';':
+			if stmt := strings.TrimSpace(b.String()); len(stmt) > 0 {
+				stmts = append(stmts, stmt)
+			}
+			b.Reset()
+		default:
+			b.WriteRune(r)
+		}
+	}
+
+	if stmt := strings.TrimSpace(b.String()); len(stmt) > 0 {
+		stmts = append(stmts, stmt)
+	}
+
+	return stmts
+}
+
+// parseAppliedAt mysql returns TIMESTAMP as text unless the DSN has parseTime=true
+func parseAppliedAt(v interface{}) time.Time {
+
+	switch v := v.(type) {
+	case time.Time:
+		return v
+	case []byte:
+		t, _ := time.Parse("2006-01-02 15:04:05", string(v))
+		return t
+	case string:
+		t, _ := time.Parse("2006-01-02 15:04:05", v)
+		return t
+	}
+
+	return time.Time{}
+}
+
+// lockKey postgres advisory lock key of name
+func lockKey(name string) int64 {
+
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return int64(h.Sum64())
+}
@@ -0,0 +1,59 @@
+package DB
+
+import (
+	"errors"
+	"testing"
+	"testing/fstest"
+)
+
+func TestLoadMigrations(t *testing.T) {
+
+	fsys := fstest.MapFS{
+		"sql/002_add_lots.up.sql":     {Data: []byte("CREATE TABLE lots (id INT)")},
+		"sql/002_add_lots.down.sql":   {Data: []byte("DROP TABLE lots")},
+		"sql/001_init.up.sql":         {Data: []byte("CREATE TABLE users (id INT)")},
+		"sql/README.md":               {Data: []byte("ignored")},
+		"sql/010_index_lots.up.sql":   {Data: []byte("CREATE INDEX lots_id ON lots (id)")},
+		"sql/010_index_lots.down.sql": {Data: []byte("DROP INDEX lots_id")},
+		"sql/nested/003_skip.up.sql":  {Data: []byte("SELECT 1")},
+	}
+
+	migrations, err := LoadMigrations(fsys, "sql")
+	if err != nil {
+		t.Fatalf("LoadMigrations: %v", err)
+	}
+
+	versions := []int64{}
+	for _, migration := range migrations {
+		versions = append(versions, migration.Version)
+	}
+	if len(versions) != 3 || versions[0] != 1 || versions[1] != 2 || versions[2] != 10 {
+		t.Fatalf("versions = %v, want [1 2 10]", versions)
+	}
+
+	if migrations[1].Name != "add_lots" || migrations[1].Down != "DROP TABLE lots" {
+		t.Fatalf("migration 2 = %+v", migrations[1])
+	}
+}
+
+func TestLoadMigrations_DuplicatedVersion(t *testing.T) {
+
+	for name, fsys := range map[string]fstest.MapFS{
+		"padding": {
+			"sql/001_init.up.sql": {Data: []byte("CREATE TABLE a (id INT)")},
+			"sql/1_init.up.sql":   {Data: []byte("CREATE TABLE b (id INT)")},
+		},
+		"name": {
+			"sql/001_init.up.sql":  {Data: []byte("CREATE TABLE a (id INT)")},
+			"sql/001_other.up.sql": {Data: []byte("CREATE TABLE b (id INT)")},
+		},
+		"direction": {
+			"sql/01_init.up.sql":  {Data: []byte("CREATE TABLE a (id INT)")},
+			"sql/1_init.down.sql": {Data: []byte("DROP TABLE a")},
+		},
+	} {
+		if _, err := LoadMigrations(fsys, "sql"); !errors.Is(err, ErrDB_MigrationDuplicated) {
+			t.Fatalf("%s: LoadMigrations = %v, want ErrDB_MigrationDuplicated", name, err)
+		}
+	}
+}
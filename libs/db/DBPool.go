@@ -0,0 +1,148 @@
+package DB
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/linxGnu/mssqlx"
+)
+
+const (
+	defaultDrainTimeout = 30 * time.Second
+)
+
+// dbPool one generation of connections with the settings it was built from.
+// DBInstance swaps whole pools on Connect so queries never see a half applied config
+type dbPool struct {
+	db            *mssqlx.DBs
+	dbType        string
+	queryTimeout  time.Duration
+	txMaxAttempts int
+	health        *dbHealth
+	stickyWindow  time.Duration
+	trackGTID     bool
+	drainTimeout  time.Duration
+	inflight      sync.WaitGroup
+
+	masterHosts []string
+	slaveHosts  []string
+	metrics     DBMetrics
+	slowQuery   time.Duration
+	metricsStop chan struct{}
+	metricsDone chan struct{}
+}
+
+func newDBPool(db *mssqlx.DBs, c *DBConfig, masterHosts, slaveHosts []string, metrics DBMetrics) *dbPool {
+
+	db.SetMaxIdleConns(c.MaxIdleConn)
+	db.SetMaxOpenConns(c.MaxOpenConn)
+	if c.ConnMaxLifetimeInMinute > 0 {
+		db.SetConnMaxLifetime(time.Duration(c.ConnMaxLifetimeInMinute) * time.Minute)
+	}
+
+	pool := &dbPool{
+		db:            db,
+		dbType:        c.Type,
+		queryTimeout:  time.Duration(c.QueryTimeoutInSecond) * time.Second,
+		txMaxAttempts: c.TxMaxAttempts,
+		stickyWindow:  time.Duration(c.StickyMasterInSecond) * time.Second,
+		trackGTID:     c.ReadYourWritesGTID && c.Type == DBType_MySQL,
+		drainTimeout:  time.Duration(c.DrainTimeoutInSecond) * time.Second,
+		masterHosts:   masterHosts,
+		slaveHosts:    slaveHosts,
+		metrics:       metrics,
+		slowQuery:     time.Duration(c.SlowQueryInMillisecond) * time.Millisecond,
+	}
+
+	if pool.drainTimeout <= 0 {
+		pool.drainTimeout = defaultDrainTimeout
+	}
+
+	if c.HealthCheckIntervalInSecond > 0 && len(c.Slaves) > 0 {
+		slaves, _ := db.GetAllSlaves()
+		pool.health = newDBHealth(c, slaveHosts, slaves)
+		pool.health.start()
+	}
+
+	if metrics != nil {
+		interval := time.Duration(c.MetricsIntervalInSecond) * time.Second
+		if interval <= 0 {
+			interval = defaultMetricsInterval
+		}
+		pool.metricsStop = make(chan struct{})
+		pool.metricsDone = make(chan struct{})
+		go pool.reportPool(interval)
+	}
+
+	return pool
+}
+
+func (this *dbPool) release() {
+	this.inflight.Done()
+}
+
+// drain wait for in-flight queries (bounded by drainTimeout) then destroy the pool.
+// Must only be called once the pool is no longer reachable through acquire
+func (this *dbPool) drain() {
+
+	done := make(chan struct{})
+	go func() {
+		this.inflight.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(this.drainTimeout):
+	}
+
+	if this.health != nil {
+		this.health.close()
+	}
+
+	if this.metricsStop != nil {
+		close(this.metricsStop)
+		<-this.metricsDone
+	}
+
+	this.db.Destroy()
+}
+
+// withTimeout apply default query timeout when ctx carries no deadline
+func (this *dbPool) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+
+	if this.queryTimeout <= 0 {
+		return ctx, func() {}
+	}
+
+	if _, ok := ctx.Deadline(); ok {
+		return ctx, func() {}
+	}
+
+	return context.WithTimeout(ctx, this.queryTimeout)
+}
+
+// slaveReader pick a healthy slave when health check is enabled, master when every slave is out of rotation.
+// Without health check reads are balanced by mssqlx
+func (this *dbPool) slaveReader() (dbReader, string) {
+
+	if this.health == nil {
+		return this.db, DBRole_Slave
+	}
+
+	if slave := this.health.pick(); slave != nil {
+		return slave, DBRole_Slave
+	}
+
+	return this.masterReader()
+}
+
+func (this *dbPool) masterReader() (dbReader, string) {
+
+	if master, _ := this.db.GetMaster(); master != nil {
+		return master, DBRole_Master
+	}
+
+	return this.db, DBRole_Master
+}
@@ -0,0 +1,201 @@
+package DB
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// DefaultLatencyBuckets upper bounds in seconds of query latency histograms
+	DefaultLatencyBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+)
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// PrometheusMetrics in-memory DBMetrics rendered in Prometheus text format, serve it on /metrics
+type PrometheusMetrics struct {
+	// metric name prefix, default "db"
+	Namespace string
+	Buckets   []float64
+
+	lock      sync.RWMutex
+	latencies map[[2]string]*histogram
+	errors    map[[2]string]uint64
+	slows     map[[2]string]uint64
+	pools     map[[2]string]sql.DBStats
+}
+
+// NewPrometheusMetrics ...
+func NewPrometheusMetrics(namespace string) *PrometheusMetrics {
+
+	if len(namespace) == 0 {
+		namespace = "db"
+	}
+
+	return &PrometheusMetrics{
+		Namespace: namespace,
+		Buckets:   DefaultLatencyBuckets,
+		latencies: make(map[[2]string]*histogram),
+		errors:    make(map[[2]string]uint64),
+		slows:     make(map[[2]string]uint64),
+		pools:     make(map[[2]string]sql.DBStats),
+	}
+}
+
+func (this *PrometheusMetrics) ObserveQuery(role, op string, duration time.Duration, err error) {
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	key := [2]string{role, op}
+	h, ok := this.latencies[key]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(this.Buckets))}
+		this.latencies[key] = h
+	}
+
+	seconds := duration.Seconds()
+	for i, bound := range this.Buckets {
+		if seconds <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += seconds
+
+	if err != nil {
+		this.errors[key]++
+	}
+}
+
+func (this *PrometheusMetrics) ObserveSlowQuery(role, op, fingerprint string, duration time.Duration) {
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.slows[[2]string{role, op}]++
+}
+
+func (this *PrometheusMetrics) ObservePool(role, node string, stats sql.DBStats) {
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.pools[[2]string{role, node}] = stats
+}
+
+// WriteTo write every metric in Prometheus text exposition format
+func (this *PrometheusMetrics) WriteTo(w io.Writer) (int64, error) {
+
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	var b strings.Builder
+	ns := this.Namespace
+
+	fmt.Fprintf(&b, "# HELP %s_query_duration_seconds Query latency by role and operation.\n", ns)
+	fmt.Fprintf(&b, "# TYPE %s_query_duration_seconds histogram\n", ns)
+	for _, key := range sortedKeys(this.latencies) {
+		h := this.latencies[key]
+		labels := fmt.Sprintf(`role="%s",op="%s"`, escapeLabel(key[0]), escapeLabel(key[1]))
+		for i, bound := range this.Buckets {
+			fmt.Fprintf(&b, "%s_query_duration_seconds_bucket{%s,le=\"%g\"} %d\n", ns, labels, bound, h.counts[i])
+		}
+		fmt.Fprintf(&b, "%s_query_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", ns, labels, h.count)
+		fmt.Fprintf(&b, "%s_query_duration_seconds_sum{%s} %g\n", ns, labels, h.sum)
+		fmt.Fprintf(&b, "%s_query_duration_seconds_count{%s} %d\n", ns, labels, h.count)
+	}
+
+	writeCounter(&b, ns+"_query_errors_total", "Failed queries by role and operation.", "op", this.errors)
+	writeCounter(&b, ns+"_slow_queries_total", "Queries over the slow query threshold by role and operation.", "op", this.slows)
+
+	gauges := []struct {
+		name, help string
+		value      func(s sql.DBStats) float64
+	}{
+		{"pool_max_open_connections", "Maximum number of open connections.", func(s sql.DBStats) float64 { return float64(s.MaxOpenConnections) }},
+		{"pool_open_connections", "Established connections, in use and idle.", func(s sql.DBStats) float64 { return float64(s.OpenConnections) }},
+		{"pool_in_use_connections", "Connections currently in use.", func(s sql.DBStats) float64 { return float64(s.InUse) }},
+		{"pool_idle_connections", "Idle connections.", func(s sql.DBStats) float64 { return float64(s.Idle) }},
+		{"pool_wait_count_total", "Total connections waited for.", func(s sql.DBStats) float64 { return float64(s.WaitCount) }},
+		{"pool_wait_duration_seconds_total", "Total time blocked waiting for a connection.", func(s sql.DBStats) float64 { return s.WaitDuration.Seconds() }},
+	}
+
+	nodes := make([][2]string, 0, len(this.pools))
+	for key := range this.pools {
+		nodes = append(nodes, key)
+	}
+	sortKeys(nodes)
+
+	for _, gauge := range gauges {
+		kind := "gauge"
+		if strings.HasSuffix(gauge.name, "_total") {
+			kind = "counter"
+		}
+		fmt.Fprintf(&b, "# HELP %s_%s %s\n", ns, gauge.name, gauge.help)
+		fmt.Fprintf(&b, "# TYPE %s_%s %s\n", ns, gauge.name, kind)
+		for _, key := range nodes {
+			fmt.Fprintf(&b, "%s_%s{role=\"%s\",node=\"%s\"} %g\n",
+				ns, gauge.name, escapeLabel(key[0]), escapeLabel(key[1]), gauge.value(this.pools[key]))
+		}
+	}
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// ServeHTTP expose metrics for Prometheus scraping
+func (this *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	this.WriteTo(w)
+}
+
+func writeCounter(b *strings.Builder, name, help, label string, values map[[2]string]uint64) {
+
+	keys := make([][2]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sortKeys(keys)
+
+	fmt.Fprintf(b, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(b, "# TYPE %s counter\n", name)
+	for _, key := range keys {
+		fmt.Fprintf(b, "%s{role=\"%s\",%s=\"%s\"} %d\n", name, escapeLabel(key[0]), label, escapeLabel(key[1]), values[key])
+	}
+}
+
+func sortedKeys(m map[[2]string]*histogram) [][2]string {
+
+	keys := make([][2]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sortKeys(keys)
+
+	return keys
+}
+
+func sortKeys(keys [][2]string) {
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+}
+
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
@@ -0,0 +1,401 @@
+package DB
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	Hashing "iparking/share/libs/crypto/Hashing"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	ShardStrategy_Hash  = "hash"
+	ShardStrategy_Range = "range"
+
+	defaultVirtualNodes = 128
+)
+
+var (
+	// ErrDB_NoShard ...
+	ErrDB_NoShard = errors.New("DB: no shard configured")
+	// ErrDB_ShardNotFound ...
+	ErrDB_ShardNotFound = errors.New("DB: no shard owns the key")
+	// ErrDB_InvalidShardKey ...
+	ErrDB_InvalidShardKey = errors.New("DB: range sharding requires an integer key")
+	// ErrDB_InvalidShardStrategy ...
+	ErrDB_InvalidShardStrategy = errors.New("DB: invalid shard strategy")
+	// ErrDB_InvalidShardName ...
+	ErrDB_InvalidShardName = errors.New("DB: shard name must be unique and non empty")
+	// ErrDB_InvalidShardRange ...
+	ErrDB_InvalidShardRange = errors.New("DB: shard ranges must be non empty and must not overlap")
+)
+
+// DBShardConfig one shard, a master/slave set of its own
+type DBShardConfig struct {
+	Name   string
+	Config DBConfig
+
+	// range strategy: shard owns integer keys in [RangeFrom, RangeTo)
+	RangeFrom int64
+	RangeTo   int64
+}
+
+type DBShardRouterConfig struct {
+
+	// hash (default): consistent hashing of the key with SipHash48
+	// range: integer key looked up in the shard range table
+	Strategy string
+
+	Shards []DBShardConfig
+
+	// SipHash key, keep it stable or keys move between shards
+	HashK0 uint64
+	HashK1 uint64
+
+	// points per shard on the hash ring, default 128
+	VirtualNodes int
+}
+
+type ringPoint struct {
+	hash  int64
+	shard int
+}
+
+// DBShardRouter route queries to one of several DBInstance shards by shard key (tenant, parking lot...)
+type DBShardRouter struct {
+	table *dbShardTable
+	lock  sync.RWMutex
+}
+
+// dbShardTable routing state of one Connect, never modified once built
+type dbShardTable struct {
+	config DBShardRouterConfig
+	names  []string
+	shards []*DBInstance
+	ring   []ringPoint
+}
+
+// Connect validate config, connect every shard and build the routing table
+func (this *DBShardRouter) Connect(config *DBShardRouterConfig) error {
+
+	if err := config.validate(); err != nil {
+		return err
+	}
+
+	shards := make([]*DBInstance, len(config.Shards))
+	names := make([]string, len(config.Shards))
+	for i := range config.Shards {
+		shard := &DBInstance{}
+		if err := shard.Connect(&config.Shards[i].Config); err != nil {
+			for _, connected := range shards[:i] {
+				connected.Close()
+			}
+			return fmt.Errorf("shard %s: %w", config.Shards[i].Name, err)
+		}
+		shards[i] = shard
+		names[i] = config.Shards[i].Name
+	}
+
+	table := &dbShardTable{config: *config, names: names, shards: shards}
+	if config.Strategy != ShardStrategy_Range {
+		table.buildRing()
+	}
+
+	// route to the new shards first, then let the old ones drain their in-flight queries
+	this.lock.Lock()
+	old := this.table
+	this.table = table
+	this.lock.Unlock()
+
+	if old != nil {
+		go old.close()
+	}
+
+	return nil
+}
+
+// validate reject configs whose shards would collide on the ring or in the range table
+func (this *DBShardRouterConfig) validate() error {
+
+	if len(this.Shards) == 0 {
+		return ErrDB_NoShard
+	}
+
+	switch this.Strategy {
+	case "", ShardStrategy_Hash, ShardStrategy_Range:
+	default:
+		return ErrDB_InvalidShardStrategy
+	}
+
+	names := make(map[string]bool, len(this.Shards))
+	for _, shard := range this.Shards {
+		if len(shard.Name) == 0 || names[shard.Name] {
+			return fmt.Errorf("%w: %q", ErrDB_InvalidShardName, shard.Name)
+		}
+		names[shard.Name] = true
+	}
+
+	if this.Strategy != ShardStrategy_Range {
+		return nil
+	}
+
+	ranges := append([]DBShardConfig{}, this.Shards...)
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].RangeFrom < ranges[j].RangeFrom
+	})
+
+	for i, shard := range ranges {
+		if shard.RangeFrom >= shard.RangeTo {
+			return fmt.Errorf("%w: %s [%d, %d)", ErrDB_InvalidShardRange, shard.Name, shard.RangeFrom, shard.RangeTo)
+		}
+		if i > 0 && ranges[i-1].RangeTo > shard.RangeFrom {
+			return fmt.Errorf("%w: %s overlaps %s", ErrDB_InvalidShardRange, shard.Name, ranges[i-1].Name)
+		}
+	}
+
+	return nil
+}
+
+// current routing table, nil before Connect
+func (this *DBShardRouter) current() *dbShardTable {
+
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	return this.table
+}
+
+func (this *dbShardTable) buildRing() {
+
+	vnodes := this.config.VirtualNodes
+	if vnodes <= 0 {
+		vnodes = defaultVirtualNodes
+	}
+
+	for i, name := range this.names {
+		for v := 0; v < vnodes; v++ {
+			this.ring = append(this.ring, ringPoint{
+				hash:  Hashing.SipHash48(this.config.HashK0, this.config.HashK1, []byte(name+"#"+strconv.Itoa(v))),
+				shard: i,
+			})
+		}
+	}
+
+	sort.Slice(this.ring, func(i, j int) bool {
+		return this.ring[i].hash < this.ring[j].hash
+	})
+}
+
+// Close close every shard
+func (this *DBShardRouter) Close() {
+
+	this.lock.Lock()
+	old := this.table
+	this.table = nil
+	this.lock.Unlock()
+
+	if old != nil {
+		old.close()
+	}
+}
+
+func (this *dbShardTable) close() {
+
+	for _, shard := range this.shards {
+		shard.Close()
+	}
+}
+
+// ShardIndex index of the shard owning key
+func (this *DBShardRouter) ShardIndex(key string) (int, error) {
+
+	table := this.current()
+	if table == nil {
+		return -1, ErrDB_NoShard
+	}
+
+	return table.shardIndex(key)
+}
+
+func (this *dbShardTable) shardIndex(key string) (int, error) {
+
+	if len(this.shards) == 0 {
+		return -1, ErrDB_NoShard
+	}
+
+	if this.config.Strategy == ShardStrategy_Range {
+		id, err := strconv.ParseInt(key, 10, 64)
+		if err != nil {
+			return -1, ErrDB_InvalidShardKey
+		}
+		for i, shard := range this.config.Shards {
+			if id >= shard.RangeFrom && id < shard.RangeTo {
+				return i, nil
+			}
+		}
+		return -1, ErrDB_ShardNotFound
+	}
+
+	h := Hashing.SipHash48(this.config.HashK0, this.config.HashK1, []byte(key))
+	i := sort.Search(len(this.ring), func(i int) bool {
+		return this.ring[i].hash >= h
+	})
+	if i == len(this.ring) {
+		i = 0
+	}
+
+	return this.ring[i].shard, nil
+}
+
+// Shard instance owning key
+func (this *DBShardRouter) Shard(key string) (*DBInstance, error) {
+
+	table := this.current()
+	if table == nil {
+		return nil, ErrDB_NoShard
+	}
+
+	i, err := table.shardIndex(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return table.shards[i], nil
+}
+
+// ShardByName ...
+func (this *DBShardRouter) ShardByName(name string) *DBInstance {
+
+	table := this.current()
+	if table == nil {
+		return nil
+	}
+
+	for i := range table.names {
+		if table.names[i] == name {
+			return table.shards[i]
+		}
+	}
+
+	return nil
+}
+
+// Shards every shard instance, in config order
+func (this *DBShardRouter) Shards() []*DBInstance {
+
+	table := this.current()
+	if table == nil {
+		return nil
+	}
+
+	return append([]*DBInstance{}, table.shards...)
+}
+
+func (this *DBShardRouter) Exec(key string, query string, args ...interface{}) (sql.Result, error) {
+	return this.ExecContext(context.Background(), key, query, args...)
+}
+
+func (this *DBShardRouter) ExecContext(ctx context.Context, key string, query string, args ...interface{}) (sql.Result, error) {
+
+	shard, err := this.Shard(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return shard.ExecContext(ctx, query, args...)
+}
+
+func (this *DBShardRouter) Select(key string, dest interface{}, query string, args ...interface{}) error {
+	return this.SelectContext(context.Background(), key, dest, query, args...)
+}
+
+func (this *DBShardRouter) SelectContext(ctx context.Context, key string, dest interface{}, query string, args ...interface{}) error {
+
+	shard, err := this.Shard(key)
+	if err != nil {
+		return err
+	}
+
+	return shard.SelectContext(ctx, dest, query, args...)
+}
+
+func (this *DBShardRouter) Get(key string, dest interface{}, query string, args ...interface{}) error {
+	return this.GetContext(context.Background(), key, dest, query, args...)
+}
+
+func (this *DBShardRouter) GetContext(ctx context.Context, key string, dest interface{}, query string, args ...interface{}) error {
+
+	shard, err := this.Shard(key)
+	if err != nil {
+		return err
+	}
+
+	return shard.GetContext(ctx, dest, query, args...)
+}
+
+// WithTx run fn in a transaction on the shard owning key
+func (this *DBShardRouter) WithTx(ctx context.Context, key string, opts *sql.TxOptions, fn func(tx *sql.Tx) error) error {
+
+	shard, err := this.Shard(key)
+	if err != nil {
+		return err
+	}
+
+	return shard.WithTx(ctx, opts, fn)
+}
+
+// ScatterSelect run query on every shard concurrently and append all rows to dest (a pointer to a slice),
+// grouped in shard order. Any shard error fails the whole call
+func (this *DBShardRouter) ScatterSelect(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+
+	v := reflect.ValueOf(dest)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Slice {
+		return ErrDB_NotSlicePointer
+	}
+
+	table := this.current()
+	if table == nil || len(table.shards) == 0 {
+		return ErrDB_NoShard
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	parts := make([]reflect.Value, len(table.shards))
+	errs := make([]error, len(table.shards))
+
+	// index of the shard that failed first, the others may only report the cancel it caused
+	failed := int32(-1)
+
+	var wg sync.WaitGroup
+	for i := range table.shards {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			parts[i] = reflect.New(v.Elem().Type())
+			if errs[i] = table.shards[i].SelectContext(ctx, parts[i].Interface(), query, args...); errs[i] != nil {
+				atomic.CompareAndSwapInt32(&failed, -1, int32(i))
+				cancel()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if failed >= 0 {
+		return fmt.Errorf("shard %s: %w", table.names[failed], errs[failed])
+	}
+
+	slice := v.Elem()
+	for i := range parts {
+		slice = reflect.AppendSlice(slice, parts[i].Elem())
+	}
+	v.Elem().Set(slice)
+
+	return nil
+}
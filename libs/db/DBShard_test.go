@@ -0,0 +1,66 @@
+package DB
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestDBShardRouter_ConnectRejectsInvalidConfig(t *testing.T) {
+
+	for name, test := range map[string]struct {
+		config DBShardRouterConfig
+		err    error
+	}{
+		"no shard": {
+			config: DBShardRouterConfig{},
+			err:    ErrDB_NoShard,
+		},
+		"strategy": {
+			config: DBShardRouterConfig{Strategy: "modulo", Shards: []DBShardConfig{{Name: "a"}}},
+			err:    ErrDB_InvalidShardStrategy,
+		},
+		"empty name": {
+			config: DBShardRouterConfig{Shards: []DBShardConfig{{Name: "a"}, {Name: ""}}},
+			err:    ErrDB_InvalidShardName,
+		},
+		"duplicated name": {
+			config: DBShardRouterConfig{Shards: []DBShardConfig{{Name: "a"}, {Name: "b"}, {Name: "a"}}},
+			err:    ErrDB_InvalidShardName,
+		},
+		"empty range": {
+			config: DBShardRouterConfig{Strategy: ShardStrategy_Range, Shards: []DBShardConfig{
+				{Name: "a", RangeFrom: 0, RangeTo: 100},
+				{Name: "b", RangeFrom: 100, RangeTo: 100},
+			}},
+			err: ErrDB_InvalidShardRange,
+		},
+		"overlapping ranges": {
+			config: DBShardRouterConfig{Strategy: ShardStrategy_Range, Shards: []DBShardConfig{
+				{Name: "b", RangeFrom: 90, RangeTo: 200},
+				{Name: "a", RangeFrom: 0, RangeTo: 100},
+			}},
+			err: ErrDB_InvalidShardRange,
+		},
+	} {
+		router := &DBShardRouter{}
+		if err := router.Connect(&test.config); !errors.Is(err, test.err) {
+			t.Fatalf("%s: Connect = %v, want %v", name, err, test.err)
+		}
+		if router.Shards() != nil {
+			t.Fatalf("%s: shards connected for an invalid config", name)
+		}
+	}
+}
+
+func TestDBShardRouterConfig_ValidRanges(t *testing.T) {
+
+	config := DBShardRouterConfig{Strategy: ShardStrategy_Range, Shards: []DBShardConfig{
+		{Name: "b", RangeFrom: 100, RangeTo: 200},
+		{Name: "a", RangeFrom: 0, RangeTo: 100},
+		{Name: "c", RangeFrom: 500, RangeTo: 1000},
+	}}
+
+	if err := config.validate(); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+}
@@ -0,0 +1,256 @@
+package DB
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	DBOp_Stream = "stream"
+)
+
+var (
+	// ErrDB_NotSlicePointer ...
+	ErrDB_NotSlicePointer = errors.New("DB: batch must be a pointer to a slice of structs")
+	// ErrDB_InvalidPageSize ...
+	ErrDB_InvalidPageSize = errors.New("DB: page size must be positive")
+	// ErrDB_KeyColumnNotFound ...
+	ErrDB_KeyColumnNotFound = errors.New("DB: key column not found in row")
+)
+
+// DBRows cursor over a result set read from a slave, rows are fetched from the server as Next is called.
+// Close must be called, it returns the connection and lets a reloading pool drain
+type DBRows struct {
+	*sqlx.Rows
+	pool  *dbPool
+	role  string
+	query string
+	start time.Time
+	once  sync.Once
+}
+
+// Close ...
+func (this *DBRows) Close() error {
+
+	err := this.Rows.Close()
+	this.once.Do(func() {
+		streamErr := this.Rows.Err()
+		if streamErr == nil {
+			streamErr = err
+		}
+		this.pool.observe(this.role, DBOp_Stream, this.query, this.start, streamErr)
+		this.pool.release()
+	})
+
+	return err
+}
+
+// QueryRows open a cursor on a slave (master while a read-your-writes session is pending).
+// The default query timeout does not apply, bound the stream with ctx. Decode rows with StructScan
+func (this *DBInstance) QueryRows(ctx context.Context, query string, args ...interface{}) (*DBRows, error) {
+
+	pool, err := this.acquire()
+	if err != nil {
+		return nil, err
+	}
+
+	reader, role := pool.reader(ctx)
+
+	start := time.Now()
+	rows, err := reader.QueryxContext(ctx, query, args...)
+	if err != nil {
+		pool.observe(role, DBOp_Stream, query, start, err)
+		pool.release()
+		return nil, err
+	}
+
+	return &DBRows{Rows: rows, pool: pool, role: role, query: query, start: start}, nil
+}
+
+// Stream decode every row into row (a pointer to a db-tagged struct) and call fn, in constant memory.
+// row is reused between calls, copy it if fn keeps it. Iteration stops at the first fn error
+func (this *DBInstance) Stream(ctx context.Context, row interface{}, fn func() error, query string, args ...interface{}) error {
+
+	rows, err := this.QueryRows(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if err := rows.StructScan(row); err != nil {
+			return err
+		}
+		if err := fn(); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// StreamBatch fill batch (a pointer to a slice of db-tagged structs) with up to size rows and call fn
+// for each full batch and the last partial one. The slice backing array is reused between calls
+func (this *DBInstance) StreamBatch(ctx context.Context, batch interface{}, size int, fn func() error, query string, args ...interface{}) error {
+
+	if size <= 0 {
+		return ErrDB_InvalidPageSize
+	}
+
+	slice, elem, err := slicePointer(batch)
+	if err != nil {
+		return err
+	}
+
+	rows, err := this.QueryRows(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	slice.SetLen(0)
+	for rows.Next() {
+
+		item := reflect.New(elem)
+		if err := rows.StructScan(item.Interface()); err != nil {
+			return err
+		}
+		slice.Set(reflect.Append(slice, item.Elem()))
+
+		if slice.Len() >= size {
+			if err := fn(); err != nil {
+				return err
+			}
+			slice.SetLen(0)
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if slice.Len() > 0 {
+		return fn()
+	}
+
+	return nil
+}
+
+// Keyset page through a table in key order: each page is one short query
+// SELECT Columns FROM Table WHERE (Where) AND Key > last ORDER BY Key LIMIT PageSize,
+// so no cursor stays open and the key index serves every page
+type Keyset struct {
+	Table    string
+	Columns  string // default *
+	Where    string // optional filter with ? placeholders bound to Args
+	Args     []interface{}
+	Key      string      // unique, indexed, db tag of the key field
+	After    interface{} // optional key to start after
+	PageSize int
+}
+
+// StreamKeyset load pages of ks into page (a pointer to a slice of db-tagged structs) and call fn
+// for each one, until a page comes back short
+func (this *DBInstance) StreamKeyset(ctx context.Context, ks Keyset, page interface{}, fn func() error) error {
+
+	if ks.PageSize <= 0 {
+		return ErrDB_InvalidPageSize
+	}
+
+	slice, _, err := slicePointer(page)
+	if err != nil {
+		return err
+	}
+
+	builder := this.Builder()
+	cols := ks.Columns
+	if len(cols) == 0 {
+		cols = "*"
+	}
+
+	after := ks.After
+	for {
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		query := "SELECT " + cols + " FROM " + builder.quote(ks.Table)
+		var args []interface{}
+		var conds []string
+
+		if len(ks.Where) > 0 {
+			conds = append(conds, "("+ks.Where+")")
+			args = append(args, ks.Args...)
+		}
+		if after != nil {
+			conds = append(conds, builder.quote(ks.Key)+" > ?")
+			args = append(args, after)
+		}
+		for i, cond := range conds {
+			if i == 0 {
+				query += " WHERE " + cond
+			} else {
+				query += " AND " + cond
+			}
+		}
+		query += " ORDER BY " + builder.quote(ks.Key) + " LIMIT " + strconv.Itoa(ks.PageSize)
+
+		slice.SetLen(0)
+		if err := this.SelectContext(ctx, page, builder.Rebind(query), args...); err != nil {
+			return err
+		}
+
+		n := slice.Len()
+		if n == 0 {
+			return nil
+		}
+
+		if err := fn(); err != nil {
+			return err
+		}
+
+		if n < ks.PageSize {
+			return nil
+		}
+
+		if after, err = keyOf(slice.Index(n-1), ks.Key); err != nil {
+			return err
+		}
+	}
+}
+
+// slicePointer addressable slice behind ptr and its struct element type
+func slicePointer(ptr interface{}) (reflect.Value, reflect.Type, error) {
+
+	v := reflect.ValueOf(ptr)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Slice {
+		return reflect.Value{}, nil, ErrDB_NotSlicePointer
+	}
+
+	slice := v.Elem()
+	elem := slice.Type().Elem()
+	if elem.Kind() != reflect.Struct {
+		return reflect.Value{}, nil, ErrDB_NotSlicePointer
+	}
+
+	return slice, elem, nil
+}
+
+// keyOf value of the field tagged key in row
+func keyOf(row reflect.Value, key string) (interface{}, error) {
+
+	for _, col := range columns(row) {
+		if col.name == key {
+			return col.value.Interface(), nil
+		}
+	}
+
+	return nil, ErrDB_KeyColumnNotFound
+}
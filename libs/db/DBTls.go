@@ -0,0 +1,162 @@
+package DB
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	Const "iparking/share/const"
+)
+
+const (
+	// TlsMode_VerifyFull verify server certificate chain and host name (default)
+	TlsMode_VerifyFull = "verify-full"
+	// TlsMode_VerifyCA verify server certificate chain only, for IP-addressed hosts
+	TlsMode_VerifyCA = "verify-ca"
+
+	// TlsCipher_Modern ECDHE key exchange with AEAD ciphers only (default)
+	TlsCipher_Modern = "modern"
+	// TlsCipher_Compatible modern suites plus ECDHE with AES-CBC for older servers
+	TlsCipher_Compatible = "compatible"
+)
+
+var (
+	// ErrDB_InvalidTlsMode ...
+	ErrDB_InvalidTlsMode = errors.New("DB: invalid tls mode")
+	// ErrDB_InvalidTlsVersion ...
+	ErrDB_InvalidTlsVersion = errors.New("DB: invalid tls min version")
+	// ErrDB_InvalidTlsCipher ...
+	ErrDB_InvalidTlsCipher = errors.New("DB: invalid tls cipher policy")
+	// ErrDB_NoPeerCertificate ...
+	ErrDB_NoPeerCertificate = errors.New("DB: server presented no certificate")
+
+	modernCipherSuites = []uint16{
+		tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+		tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	}
+
+	compatibleCipherSuites = append(append([]uint16{}, modernCipherSuites...),
+		tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+		tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+		tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	)
+)
+
+// tlsMode configured verification mode, defaults to verify-full
+func (this *DBConfig) tlsMode() string {
+
+	if len(this.TlsMode) == 0 {
+		return TlsMode_VerifyFull
+	}
+
+	return this.TlsMode
+}
+
+// TLSConfig build client tls config from CaCert, ClientCert/ClientKey and Tls* settings.
+// In verify-full mode the driver fills ServerName with the host of each connection
+func (this *DBConfig) TLSConfig() (*tls.Config, error) {
+
+	rootCertPool, err := this.rootCertPool()
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		RootCAs:          rootCertPool,
+		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP384, tls.CurveP256},
+	}
+
+	switch this.TlsMinVersion {
+	case "", "1.2":
+		config.MinVersion = tls.VersionTLS12
+	case "1.3":
+		config.MinVersion = tls.VersionTLS13
+	default:
+		return nil, ErrDB_InvalidTlsVersion
+	}
+
+	switch this.TlsCipherPolicy {
+	case "", TlsCipher_Modern:
+		config.CipherSuites = modernCipherSuites
+	case TlsCipher_Compatible:
+		config.CipherSuites = compatibleCipherSuites
+	default:
+		return nil, ErrDB_InvalidTlsCipher
+	}
+
+	if len(this.ClientCert) > 0 || len(this.ClientKey) > 0 {
+		cert, err := tls.LoadX509KeyPair(this.ClientCert, this.ClientKey)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	switch this.tlsMode() {
+	case TlsMode_VerifyFull:
+	case TlsMode_VerifyCA:
+		// skip the built-in verification (which includes host name) and verify the chain ourselves
+		config.InsecureSkipVerify = true
+		config.VerifyPeerCertificate = verifyChain(rootCertPool)
+	default:
+		return nil, ErrDB_InvalidTlsMode
+	}
+
+	return config, nil
+}
+
+// rootCertPool load CaCert, or system roots when CaCert is empty
+func (this *DBConfig) rootCertPool() (*x509.CertPool, error) {
+
+	if len(this.CaCert) == 0 {
+		return x509.SystemCertPool()
+	}
+
+	pem, err := ioutil.ReadFile(this.CaCert)
+	if err != nil {
+		return nil, err
+	}
+
+	rootCertPool := x509.NewCertPool()
+	if ok := rootCertPool.AppendCertsFromPEM(pem); !ok {
+		return nil, Const.ErrDB_FailedAppendPEM
+	}
+
+	return rootCertPool, nil
+}
+
+// verifyChain verify server certificate chain against roots without checking host name
+func verifyChain(roots *x509.CertPool) func([][]byte, [][]*x509.Certificate) error {
+
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+
+		if len(rawCerts) == 0 {
+			return ErrDB_NoPeerCertificate
+		}
+
+		certs := make([]*x509.Certificate, len(rawCerts))
+		for i := range rawCerts {
+			cert, err := x509.ParseCertificate(rawCerts[i])
+			if err != nil {
+				return err
+			}
+			certs[i] = cert
+		}
+
+		intermediates := x509.NewCertPool()
+		for _, cert := range certs[1:] {
+			intermediates.AddCert(cert)
+		}
+
+		_, err := certs[0].Verify(x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: intermediates,
+		})
+		return err
+	}
+}
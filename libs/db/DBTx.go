@@ -0,0 +1,111 @@
+package DB
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+)
+
+const (
+	txBackoffBase = 20 * time.Millisecond
+	txBackoffMax  = time.Second
+)
+
+// WithTx run fn inside a transaction on master. The transaction is committed when fn returns nil,
+// rolled back when fn returns an error or panics. Whole fn is retried with backoff on deadlock,
+// lock wait timeout and serialization failure, up to DBConfig.TxMaxAttempts attempts
+func (this *DBInstance) WithTx(ctx context.Context, opts *sql.TxOptions, fn func(tx *sql.Tx) error) error {
+
+	pool, err := this.acquire()
+	if err != nil {
+		return err
+	}
+	defer pool.release()
+
+	attempts := pool.txMaxAttempts
+	if attempts <= 0 {
+		attempts = 1
+	}
+
+	for i := 0; i < attempts; i++ {
+
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(txBackoff(i)):
+			}
+		}
+
+		start := time.Now()
+		err = pool.runTx(ctx, opts, fn)
+		pool.observe(DBRole_Master, DBOp_Tx, "", start, err)
+
+		if err == nil || !IsRetryableTxError(err) {
+			return err
+		}
+	}
+
+	return err
+}
+
+func (this *dbPool) runTx(ctx context.Context, opts *sql.TxOptions, fn func(tx *sql.Tx) error) error {
+
+	tx, err := this.db.BeginTx(ctx, opts)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		}
+	}()
+
+	if err = fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	this.markWrite(ctx)
+	return nil
+}
+
+// IsRetryableTxError check if err is a deadlock, lock wait timeout or serialization failure
+func IsRetryableTxError(err error) bool {
+
+	var myErr *mysql.MySQLError
+	if errors.As(err, &myErr) {
+		// 1213: ER_LOCK_DEADLOCK, 1205: ER_LOCK_WAIT_TIMEOUT
+		return myErr.Number == 1213 || myErr.Number == 1205
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		// 40001: serialization_failure, 40P01: deadlock_detected
+		return pqErr.Code == "40001" || pqErr.Code == "40P01"
+	}
+
+	return false
+}
+
+// txBackoff exponential backoff with jitter for retry attempt n (n >= 1)
+func txBackoff(n int) time.Duration {
+
+	d := txBackoffBase << uint(n-1)
+	if d <= 0 || d > txBackoffMax {
+		d = txBackoffMax
+	}
+
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
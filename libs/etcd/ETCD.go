@@ -2,21 +2,45 @@ package ETCD
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
 	"reflect"
+	"sync"
 
 	Const "iparking/share/const"
 
 	etcd "github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+)
+
+var (
+	ErrETCD_TypeMismatch = errors.New("etcd key is already registered with another type")
+	ErrETCD_NoClient     = errors.New("etcd client is not dialed, leases need Init rather than InitWith")
 )
 
 type ETCDClient struct {
-	Client    *etcd.Client
-	Context   context.Context
-	Configs   map[string]ETCDConfig
-	WatchChan chan ETCDConfig
+	Client  *etcd.Client
+	Context context.Context
+
+	// WatchChan configs changed by a watcher. Once it is full a watcher waits for a reader before applying
+	// the next change, set it to nil before watching when only ETCDConfig.Subscribe is used
+	WatchChan chan *ETCDConfig
+
+	// OnWatchState called when a watcher started by WatchAll changes state
+	OnWatchState func(watcher *ETCDWatcher, state ETCDWatchState, err error)
+
+	configs   map[string]*ETCDConfig
+	prefixes  map[string]*ETCDPrefix
+	watchers  map[string]*ETCDWatcher
+	secretKey *ecdsa.PrivateKey
+	kv        etcd.KV
+	watcher   etcd.Watcher
+	lock      sync.RWMutex
 }
 
+const etcdWatchChanSize = 64
+
 func init() {
 
 }
@@ -28,65 +52,269 @@ func (this *ETCDClient) Init(conf etcd.Config) error {
 		return err
 	}
 
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
 	this.Client = client
 	this.Context = context.Background()
-	this.Configs = make(map[string]ETCDConfig)
-	this.WatchChan = make(chan ETCDConfig)
+	this.configs = make(map[string]*ETCDConfig)
+	this.prefixes = make(map[string]*ETCDPrefix)
+	this.WatchChan = make(chan *ETCDConfig, etcdWatchChanSize)
 
 	return nil
 }
 
+// InitWith init client over the given kv and watcher (a namespaced view or an ETCDTest.FakeETCD) instead of
+// dialing etcd. Leases, sessions and service registration need Client and fail with ErrETCD_NoClient
+func (this *ETCDClient) InitWith(kv etcd.KV, watcher etcd.Watcher) {
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.kv = kv
+	this.watcher = watcher
+	this.Context = context.Background()
+	this.configs = make(map[string]*ETCDConfig)
+	this.prefixes = make(map[string]*ETCDPrefix)
+	this.WatchChan = make(chan *ETCDConfig, etcdWatchChanSize)
+}
+
+func (this *ETCDClient) kvClient() etcd.KV {
+
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	if this.kv != nil {
+		return this.kv
+	}
+	return this.Client
+}
+
+// leaseClient dialed client for leases, ErrETCD_NoClient when only InitWith was called
+func (this *ETCDClient) leaseClient() (*etcd.Client, error) {
+
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	if this.Client == nil {
+		return nil, ErrETCD_NoClient
+	}
+	return this.Client, nil
+}
+
+func (this *ETCDClient) watchClient() etcd.Watcher {
+
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	if this.watcher != nil {
+		return this.watcher
+	}
+	return this.Client
+}
+
+// Register register key and load it, nil when it is missing or cannot be loaded. Use RegisterConfig
+// to see the error
 func (this *ETCDClient) Register(key string, objType reflect.Type) interface{} {
 
-	this.Configs[key] = ETCDConfig{Key: key, Type: objType, Content: nil}
+	config, err := this.RegisterConfig(key, objType)
+	if err != nil || !config.Loaded() {
+		return nil
+	}
 
-	value, err := this.Refresh(key)
+	return config.Content()
+}
+
+// RegisterConfig register key and load it. A key registered again keeps its config, so earlier
+// subscribers and handles stay attached, ErrETCD_TypeMismatch when objType differs. A missing key is not
+// an error, the config stays empty until it is put
+func (this *ETCDClient) RegisterConfig(key string, objType reflect.Type) (*ETCDConfig, error) {
+
+	config, err := this.register(&ETCDConfig{Key: key, Type: objType})
 	if err != nil {
-		return nil
+		return nil, err
 	}
 
-	return value
+	if _, err := this.refresh(key); err != nil {
+		return config, err
+	}
+
+	return config, nil
+}
+
+// register add config, or return the config already registered for its key when Type matches
+func (this *ETCDClient) register(config *ETCDConfig) (*ETCDConfig, error) {
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.configs == nil {
+		this.configs = make(map[string]*ETCDConfig)
+	}
+
+	if registered, ok := this.configs[config.Key]; ok {
+		if registered.Type != config.Type {
+			return nil, fmt.Errorf("%w: %s is %v", ErrETCD_TypeMismatch, config.Key, registered.Type)
+		}
+		return registered, nil
+	}
+
+	config.open = this.openSecrets
+	this.configs[config.Key] = config
+
+	return config, nil
+}
+
+// Config registered holder of key, nil when key is not registered
+func (this *ETCDClient) Config(key string) *ETCDConfig {
+
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	return this.configs[key]
 }
 
+// Keys registered keys
+func (this *ETCDClient) Keys() []string {
+
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	keys := make([]string, 0, len(this.configs))
+	for key := range this.configs {
+		keys = append(keys, key)
+	}
+
+	return keys
+}
+
+// WatchAll start a supervised watcher for every registered key and prefix not watched yet
 func (this *ETCDClient) WatchAll() {
 
-	for key, _ := range this.Configs {
+	for _, key := range this.Keys() {
+		this.Watch(key)
+	}
+
+	for _, prefix := range this.Prefixes() {
+		this.WatchPrefix(prefix)
+	}
+}
 
-		go func(this *ETCDClient, key string) {
+// Watch keep key up to date, changes reach subscribers of the config and WatchChan. Returns the running watcher of key if any
+func (this *ETCDClient) Watch(key string) *ETCDWatcher {
+
+	watcher := &ETCDWatcher{
+		Key: key,
+		reload: func() (int64, error) {
+			return this.refresh(key)
+		},
+		handle: func(ctx context.Context, events []*etcd.Event) {
+			this.applyKey(ctx, key, events)
+		},
+	}
 
-			defer func() {
-				if e := recover(); e != nil {
-				}
-			}()
+	return this.startWatcher(key, watcher)
+}
 
-			watchan := this.Client.Watch(this.Context, key)
-			for v := range watchan {
-				if v.Err() != nil {
-					continue
-				}
+// StopWatch stop every watcher and wait for them to finish
+func (this *ETCDClient) StopWatch() {
 
-				this.Refresh(key)
+	this.lock.Lock()
+	watchers := this.watchers
+	this.watchers = nil
+	this.lock.Unlock()
 
-				this.WatchChan <- this.Configs[key]
-			}
+	for _, watcher := range watchers {
+		watcher.Stop()
+	}
+}
+
+// stopWatcher stop watcher and forget it unless name was taken over by another watcher
+func (this *ETCDClient) stopWatcher(name string, watcher *ETCDWatcher) {
+
+	this.lock.Lock()
+	if this.watchers[name] == watcher {
+		delete(this.watchers, name)
+	}
+	this.lock.Unlock()
+
+	watcher.Stop()
+}
+
+// Watchers running watchers
+func (this *ETCDClient) Watchers() []*ETCDWatcher {
+
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	watchers := make([]*ETCDWatcher, 0, len(this.watchers))
+	for _, watcher := range this.watchers {
+		watchers = append(watchers, watcher)
+	}
+
+	return watchers
+}
+
+func (this *ETCDClient) startWatcher(name string, watcher *ETCDWatcher) *ETCDWatcher {
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
 
-		}(this, key)
+	if running, ok := this.watchers[name]; ok {
+		return running
 	}
+
+	if this.watchers == nil {
+		this.watchers = make(map[string]*ETCDWatcher)
+	}
+
+	watcher.client = this
+	watcher.OnState = this.OnWatchState
+	this.watchers[name] = watcher
+	watcher.start(this.Context)
+
+	return watcher
 }
 
-func (this *ETCDClient) Set(jsonPath string) {
+// applyKey store the last put of key and send it to WatchChan, waiting for room until ctx is done. A
+// delete keeps the last value
+func (this *ETCDClient) applyKey(ctx context.Context, key string, events []*etcd.Event) {
+
+	config := this.Config(key)
+	if config == nil {
+		return
+	}
+
+	for i := len(events) - 1; i >= 0; i-- {
+		if events[i].Type != mvccpb.PUT {
+			continue
+		}
+
+		obj, err := config.decode(events[i].Kv.Value)
+		if err != nil || !config.store(obj, events[i].Kv.ModRevision) {
+			return
+		}
 
+		if this.WatchChan != nil {
+			select {
+			case this.WatchChan <- config:
+			case <-ctx.Done():
+			}
+		}
+		return
+	}
 }
 
+// Get cached value of key, fetched from etcd only when not loaded yet
 func (this *ETCDClient) Get(key string) interface{} {
 
-	config, ok := this.Configs[key]
-	if ok == false {
+	config := this.Config(key)
+	if config == nil {
 		return nil
 	}
 
-	if config.Content != nil {
-		return config.Content
+	if config.Loaded() {
+		return config.Content()
 	}
 
 	value, err := this.Refresh(key)
@@ -98,26 +326,42 @@ func (this *ETCDClient) Get(key string) interface{} {
 	return value
 }
 
+// Refresh fetch key from etcd and replace the cached value
 func (this *ETCDClient) Refresh(key string) (interface{}, error) {
 
-	config, ok := this.Configs[key]
-	if ok == false {
-		return nil, Const.ErrETCD_NotFoundKey
+	if _, err := this.refresh(key); err != nil {
+		return nil, err
 	}
 
-	resp, err := this.Client.Get(context.Background(), key)
-	if err != nil || resp.Count <= 0 {
-		return nil, err
+	config := this.Config(key)
+	if !config.Loaded() {
+		return nil, nil
 	}
 
-	obj := reflect.New(config.Type).Interface()
-	if err = json.Unmarshal([]byte(resp.Kvs[0].Value), &obj); err != nil {
-		return nil, err
+	return config.Content(), nil
+}
+
+// refresh fetch key into its config, returning the store revision it was read at
+func (this *ETCDClient) refresh(key string) (int64, error) {
+
+	config := this.Config(key)
+	if config == nil {
+		return 0, Const.ErrETCD_NotFoundKey
+	}
+
+	resp, err := this.kvClient().Get(this.Context, key)
+	if err != nil {
+		return 0, err
 	}
 
-	config.Locker.Lock()
-	defer config.Locker.Unlock()
-	config.Content = obj
+	if resp.Count > 0 {
+		obj, err := config.decode(resp.Kvs[0].Value)
+		if err != nil {
+			return 0, err
+		}
+
+		config.store(obj, resp.Kvs[0].ModRevision)
+	}
 
-	return config.Content, nil
+	return resp.Header.Revision, nil
 }
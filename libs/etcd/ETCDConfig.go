@@ -1,13 +1,101 @@
 package ETCD
 
 import (
+	"encoding/json"
 	"reflect"
 	"sync"
-
+	"sync/atomic"
 )
+
 type ETCDConfig struct {
-	Key     string
-	Type    reflect.Type
-	Content interface{}
-	Locker  sync.RWMutex
+	Key  string
+	Type reflect.Type
+
+	// Decode optional decoder replacing json into Type, set by RegisterTyped
+	Decode func(data []byte) (interface{}, error)
+
+	open        func(data []byte) ([]byte, error) // decrypts secret fields before decoding
+	content     atomic.Value                      // configContent
+	subscribers []func(value interface{}, revision int64)
+	locker      sync.Mutex // orders stores, reads go through content only
+}
+
+type configContent struct {
+	value    interface{}
+	revision int64
+}
+
+// Content last decoded value, nil when not loaded yet
+func (this *ETCDConfig) Content() interface{} {
+
+	content, _ := this.content.Load().(configContent)
+	return content.value
+}
+
+// Revision etcd ModRevision of Content, 0 when not loaded yet
+func (this *ETCDConfig) Revision() int64 {
+
+	content, _ := this.content.Load().(configContent)
+	return content.revision
+}
+
+// Loaded whether Content holds a value
+func (this *ETCDConfig) Loaded() bool {
+	return this.Revision() > 0
+}
+
+// decode value into a new Type, or through Decode when set
+func (this *ETCDConfig) decode(data []byte) (interface{}, error) {
+
+	if this.open != nil {
+		var err error
+		if data, err = this.open(data); err != nil {
+			return nil, err
+		}
+	}
+
+	if this.Decode != nil {
+		return this.Decode(data)
+	}
+
+	obj := reflect.New(this.Type).Interface()
+	if err := json.Unmarshal(data, obj); err != nil {
+		return nil, err
+	}
+
+	return obj, nil
+}
+
+// Subscribe call fn with every newer value stored, from etcd or a local Put
+func (this *ETCDConfig) Subscribe(fn func(value interface{}, revision int64)) {
+
+	this.locker.Lock()
+	defer this.locker.Unlock()
+
+	this.subscribers = append(this.subscribers, fn)
+}
+
+// store replace content unless a newer revision is already stored. Subscribers are notified when
+// the revision moved forward
+func (this *ETCDConfig) store(value interface{}, revision int64) bool {
+
+	this.locker.Lock()
+
+	current := this.Revision()
+	if revision < current {
+		this.locker.Unlock()
+		return false
+	}
+
+	this.content.Store(configContent{value: value, revision: revision})
+	subscribers := this.subscribers
+	this.locker.Unlock()
+
+	if revision > current {
+		for _, fn := range subscribers {
+			fn(value, revision)
+		}
+	}
+
+	return true
 }
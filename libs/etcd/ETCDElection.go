@@ -0,0 +1,180 @@
+package ETCD
+
+import (
+	"context"
+	"sync"
+
+	etcd "github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/clientv3/concurrency"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+)
+
+// ETCDElection leader election under Prefix. OnElected and OnRevoked are called when this session gains
+// and loses leadership, loss covering Resign, an expired session, the leader key being removed or
+// another campaigner being elected
+type ETCDElection struct {
+	Prefix string
+
+	OnElected func()
+	OnRevoked func()
+
+	client   *ETCDClient
+	session  *concurrency.Session
+	election *concurrency.Election
+	leader   bool
+	cancel   context.CancelFunc
+	lock     sync.Mutex
+}
+
+// NewElection election under prefix campaigned by session
+func (this *ETCDClient) NewElection(session *concurrency.Session, prefix string) *ETCDElection {
+	return &ETCDElection{
+		Prefix:   prefix,
+		client:   this,
+		session:  session,
+		election: concurrency.NewElection(session, prefix),
+	}
+}
+
+// Campaign wait until this session is elected with value, or ctx is done
+func (this *ETCDElection) Campaign(ctx context.Context, value string) error {
+
+	if err := this.election.Campaign(ctx, value); err != nil {
+		return err
+	}
+
+	watchCtx, cancel := context.WithCancel(this.client.Context)
+
+	this.lock.Lock()
+	this.leader = true
+	this.cancel = cancel
+	this.lock.Unlock()
+
+	if this.OnElected != nil {
+		this.OnElected()
+	}
+
+	go this.watchLeadership(watchCtx)
+	return nil
+}
+
+// Resign give up leadership so another campaigner can be elected
+func (this *ETCDElection) Resign(ctx context.Context) error {
+
+	this.lock.Lock()
+	if this.cancel != nil {
+		this.cancel()
+	}
+	this.lock.Unlock()
+
+	err := this.election.Resign(ctx)
+	this.revoke()
+
+	return err
+}
+
+// IsLeader whether this session currently leads
+func (this *ETCDElection) IsLeader() bool {
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	return this.leader
+}
+
+// Leader value of the current leader, concurrency.ErrElectionNoLeader when there is none
+func (this *ETCDElection) Leader(ctx context.Context) (string, error) {
+
+	resp, err := this.election.Leader(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	return string(resp.Kvs[0].Value), nil
+}
+
+// Observe value of every new leader until ctx is done
+func (this *ETCDElection) Observe(ctx context.Context) <-chan string {
+
+	leaders := make(chan string)
+
+	go func() {
+		defer close(leaders)
+
+		for resp := range this.election.Observe(ctx) {
+			if len(resp.Kvs) == 0 {
+				continue
+			}
+
+			select {
+			case leaders <- string(resp.Kvs[0].Value):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return leaders
+}
+
+// watchLeadership revoke leadership when the session expires, our leader key is removed or another key
+// becomes leader
+func (this *ETCDElection) watchLeadership(ctx context.Context) {
+
+	observe := this.election.Observe(ctx)
+	key := this.election.Key()
+
+	// Observe only reports the next leader, so a lone campaigner losing its key is seen on the key itself
+	removed := this.session.Client().Watch(ctx, key, etcd.WithRev(this.election.Rev()+1))
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-this.session.Done():
+			this.revoke()
+			return
+
+		case resp, ok := <-removed:
+			if ctx.Err() != nil {
+				return
+			}
+			if !ok || resp.Err() != nil {
+				this.revoke()
+				return
+			}
+			for _, event := range resp.Events {
+				if event.Type == mvccpb.DELETE {
+					this.revoke()
+					return
+				}
+			}
+
+		case resp, ok := <-observe:
+			if ctx.Err() != nil {
+				return
+			}
+			if !ok || len(resp.Kvs) == 0 || string(resp.Kvs[0].Key) != key {
+				this.revoke()
+				return
+			}
+		}
+	}
+}
+
+func (this *ETCDElection) revoke() {
+
+	this.lock.Lock()
+	wasLeader := this.leader
+	this.leader = false
+	if this.cancel != nil {
+		this.cancel()
+		this.cancel = nil
+	}
+	this.lock.Unlock()
+
+	if wasLeader && this.OnRevoked != nil {
+		this.OnRevoked()
+	}
+}
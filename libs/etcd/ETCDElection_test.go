@@ -0,0 +1,100 @@
+package ETCD
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestETCDElection_SessionExpired(t *testing.T) {
+
+	client := newEmbeddedClient(t)
+	ctx := context.Background()
+
+	session := newTestSession(t, client)
+	leader := client.NewElection(session, "/election/expire")
+
+	elected := make(chan struct{}, 1)
+	revoked := make(chan struct{}, 1)
+	leader.OnElected = func() { elected <- struct{}{} }
+	leader.OnRevoked = func() { revoked <- struct{}{} }
+
+	if err := leader.Campaign(ctx, "first"); err != nil {
+		t.Fatalf("Campaign: %v", err)
+	}
+
+	select {
+	case <-elected:
+	default:
+		t.Fatal("OnElected not called")
+	}
+
+	follower := client.NewElection(newTestSession(t, client), "/election/expire")
+	campaign := make(chan error, 1)
+	go func() {
+		campaign <- follower.Campaign(ctx, "second")
+	}()
+
+	// expire the leader session as if its keepalives stopped reaching etcd
+	if _, err := client.Client.Revoke(ctx, session.Lease()); err != nil {
+		t.Fatalf("Revoke: %v", err)
+	}
+
+	select {
+	case <-revoked:
+	case <-time.After(10 * time.Second):
+		t.Fatal("OnRevoked not called after the session expired")
+	}
+
+	if leader.IsLeader() {
+		t.Fatal("IsLeader after the session expired")
+	}
+
+	select {
+	case err := <-campaign:
+		if err != nil {
+			t.Fatalf("follower Campaign: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("follower not elected after the leader expired")
+	}
+
+	value, err := follower.Leader(ctx)
+	if err != nil || value != "second" {
+		t.Fatalf("Leader = %q, %v, want %q", value, err, "second")
+	}
+
+	if !follower.IsLeader() {
+		t.Fatal("follower IsLeader = false")
+	}
+}
+
+func TestETCDElection_LeaderKeyRemoved(t *testing.T) {
+
+	client := newEmbeddedClient(t)
+	ctx := context.Background()
+
+	leader := client.NewElection(newTestSession(t, client), "/election/removed")
+
+	revoked := make(chan struct{}, 1)
+	leader.OnRevoked = func() { revoked <- struct{}{} }
+
+	if err := leader.Campaign(ctx, "only"); err != nil {
+		t.Fatalf("Campaign: %v", err)
+	}
+
+	// no other campaigner, so Observe has nothing to report
+	if _, err := client.Client.Delete(ctx, leader.election.Key()); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+
+	select {
+	case <-revoked:
+	case <-time.After(10 * time.Second):
+		t.Fatal("OnRevoked not called after the leader key was removed")
+	}
+
+	if leader.IsLeader() {
+		t.Fatal("IsLeader after the leader key was removed")
+	}
+}
@@ -0,0 +1,155 @@
+package ETCD
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	etcd "github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/clientv3/concurrency"
+)
+
+var (
+	ErrETCD_Locked    = errors.New("etcd lock is held by another session")
+	ErrETCD_NotLocked = errors.New("etcd lock is not held")
+)
+
+// NewSession session whose lease is kept alive until Close, or lost after ttlInSecond without contact.
+// Locks and elections made on it are released with it
+func (this *ETCDClient) NewSession(ttlInSecond int) (*concurrency.Session, error) {
+
+	client, err := this.leaseClient()
+	if err != nil {
+		return nil, err
+	}
+
+	return concurrency.NewSession(client, concurrency.WithTTL(ttlInSecond), concurrency.WithContext(this.Context))
+}
+
+// ETCDMutex distributed mutex under Prefix, compatible with concurrency.Mutex on the same prefix
+type ETCDMutex struct {
+	Prefix string
+
+	session   *concurrency.Session
+	key       string
+	locked    bool
+	acquiring bool // a Lock is waiting in etcd with key
+	lock      sync.Mutex
+}
+
+// NewMutex mutex under prefix owned by session
+func (this *ETCDClient) NewMutex(session *concurrency.Session, prefix string) *ETCDMutex {
+	return &ETCDMutex{
+		Prefix:  prefix,
+		session: session,
+		key:     fmt.Sprintf("%s/%x", prefix, session.Lease()),
+	}
+}
+
+// Key etcd key of this session in the lock queue
+func (this *ETCDMutex) Key() string {
+	return this.key
+}
+
+// Locked whether this mutex holds the lock
+func (this *ETCDMutex) Locked() bool {
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	return this.locked
+}
+
+// Lock wait until the lock is acquired or ctx is done. The local mutex is not held while waiting on
+// etcd, so Locked, TryLock and Unlock stay responsive. ErrETCD_Locked when another Lock of this mutex
+// is already waiting
+func (this *ETCDMutex) Lock(ctx context.Context) error {
+
+	this.lock.Lock()
+	if this.locked {
+		this.lock.Unlock()
+		return nil
+	}
+	if this.acquiring {
+		this.lock.Unlock()
+		return ErrETCD_Locked
+	}
+	this.acquiring = true
+	this.lock.Unlock()
+
+	// on failure concurrency.Mutex removes key itself, acquiring keeps TryLock from reusing it meanwhile
+	err := concurrency.NewMutex(this.session, this.Prefix).Lock(ctx)
+
+	this.lock.Lock()
+	this.acquiring = false
+	this.locked = err == nil
+	this.lock.Unlock()
+
+	return err
+}
+
+// TryLock acquire the lock without waiting, ErrETCD_Locked when another session holds or waits for it,
+// or a Lock of this mutex is waiting
+func (this *ETCDMutex) TryLock(ctx context.Context) error {
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.locked {
+		return nil
+	}
+	if this.acquiring {
+		return ErrETCD_Locked
+	}
+
+	// the session client, as concurrency.Mutex does in Lock
+	client := this.session.Client()
+	_, err := client.Txn(ctx).
+		If(etcd.Compare(etcd.CreateRevision(this.key), "=", 0)).
+		Then(etcd.OpPut(this.key, "", etcd.WithLease(this.session.Lease()))).
+		Commit()
+	if err != nil {
+		return err
+	}
+
+	own, err := client.Get(ctx, this.key)
+	if err != nil {
+		return err
+	}
+	if len(own.Kvs) == 0 {
+		return ErrETCD_NotLocked
+	}
+
+	// the oldest key of the prefix owns the lock, any key created before ours is an owner or a waiter
+	older, err := client.Get(ctx, this.Prefix+"/", etcd.WithPrefix(), etcd.WithMaxCreateRev(own.Kvs[0].CreateRevision-1), etcd.WithKeysOnly())
+	if err != nil {
+		return err
+	}
+
+	if older.Count > 0 {
+		client.Delete(ctx, this.key)
+		return ErrETCD_Locked
+	}
+
+	this.locked = true
+	return nil
+}
+
+// Unlock release the lock
+func (this *ETCDMutex) Unlock(ctx context.Context) error {
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if !this.locked {
+		return ErrETCD_NotLocked
+	}
+
+	if _, err := this.session.Client().Delete(ctx, this.key); err != nil {
+		return err
+	}
+
+	this.locked = false
+	return nil
+}
@@ -0,0 +1,237 @@
+package ETCD
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	etcd "github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/clientv3/concurrency"
+	"github.com/coreos/etcd/embed"
+)
+
+// newEmbeddedClient client of a single node etcd running in the test process
+func newEmbeddedClient(t *testing.T) *ETCDClient {
+
+	t.Helper()
+
+	cfg := embed.NewConfig()
+	cfg.Dir = t.TempDir()
+	cfg.LCUrls = []url.URL{freeURL(t)}
+	cfg.ACUrls = cfg.LCUrls
+	cfg.LPUrls = []url.URL{freeURL(t)}
+	cfg.APUrls = cfg.LPUrls
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+
+	server, err := embed.StartEtcd(cfg)
+	if err != nil {
+		t.Fatalf("StartEtcd: %v", err)
+	}
+	t.Cleanup(server.Close)
+
+	select {
+	case <-server.Server.ReadyNotify():
+	case err := <-server.Err():
+		t.Fatalf("embedded etcd: %v", err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("embedded etcd not ready")
+	}
+
+	client := &ETCDClient{}
+	if err := client.Init(etcd.Config{Endpoints: []string{cfg.ACUrls[0].String()}, DialTimeout: 5 * time.Second}); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	t.Cleanup(func() { client.Client.Close() })
+
+	return client
+}
+
+func freeURL(t *testing.T) url.URL {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer listener.Close()
+
+	return url.URL{Scheme: "http", Host: listener.Addr().String()}
+}
+
+func newTestSession(t *testing.T, client *ETCDClient) *concurrency.Session {
+
+	t.Helper()
+
+	session, err := client.NewSession(5)
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	t.Cleanup(func() { session.Close() })
+
+	return session
+}
+
+func TestETCDMutex_TryLockContention(t *testing.T) {
+
+	client := newEmbeddedClient(t)
+	ctx := context.Background()
+
+	first := client.NewMutex(newTestSession(t, client), "/lock/trylock")
+	second := client.NewMutex(newTestSession(t, client), "/lock/trylock")
+
+	if err := first.TryLock(ctx); err != nil {
+		t.Fatalf("first TryLock: %v", err)
+	}
+	if err := second.TryLock(ctx); err != ErrETCD_Locked {
+		t.Fatalf("second TryLock = %v, want ErrETCD_Locked", err)
+	}
+
+	// a failed TryLock must not leave a waiter key behind
+	resp, err := client.Client.Get(ctx, second.Key())
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if resp.Count != 0 {
+		t.Fatalf("second key %s left in the queue", second.Key())
+	}
+
+	if err := first.Unlock(ctx); err != nil {
+		t.Fatalf("first Unlock: %v", err)
+	}
+	if err := second.TryLock(ctx); err != nil {
+		t.Fatalf("second TryLock after Unlock: %v", err)
+	}
+	if err := first.TryLock(ctx); err != ErrETCD_Locked {
+		t.Fatalf("first TryLock = %v, want ErrETCD_Locked", err)
+	}
+
+	if !second.Locked() || first.Locked() {
+		t.Fatalf("Locked = %v/%v, want false/true", first.Locked(), second.Locked())
+	}
+}
+
+func TestETCDMutex_LockCancel(t *testing.T) {
+
+	client := newEmbeddedClient(t)
+
+	holder := client.NewMutex(newTestSession(t, client), "/lock/cancel")
+	waiter := client.NewMutex(newTestSession(t, client), "/lock/cancel")
+
+	if err := holder.Lock(context.Background()); err != nil {
+		t.Fatalf("holder Lock: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		result <- waiter.Lock(ctx)
+	}()
+
+	// the waiter blocks in etcd, its local state must stay readable meanwhile
+	checked := make(chan bool, 1)
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		checked <- waiter.Locked()
+	}()
+
+	select {
+	case locked := <-checked:
+		if locked {
+			t.Fatal("waiter Locked while holder owns the lock")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Locked blocked behind a pending Lock")
+	}
+
+	cancel()
+
+	select {
+	case err := <-result:
+		if err != context.Canceled {
+			t.Fatalf("waiter Lock = %v, want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("waiter Lock ignored ctx cancel")
+	}
+
+	if waiter.Locked() {
+		t.Fatal("waiter Locked after cancel")
+	}
+
+	if err := holder.Unlock(context.Background()); err != nil {
+		t.Fatalf("holder Unlock: %v", err)
+	}
+
+	// the canceled waiter removed its key, so the lock is free again
+	if err := waiter.TryLock(context.Background()); err != nil {
+		t.Fatalf("waiter TryLock after cancel: %v", err)
+	}
+}
+
+func TestETCDMutex_TryLockWhileLocking(t *testing.T) {
+
+	client := newEmbeddedClient(t)
+	ctx := context.Background()
+
+	holder := client.NewMutex(newTestSession(t, client), "/lock/pending")
+	waiter := client.NewMutex(newTestSession(t, client), "/lock/pending")
+
+	if err := holder.Lock(ctx); err != nil {
+		t.Fatalf("holder Lock: %v", err)
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		result <- waiter.Lock(ctx)
+	}()
+
+	// wait for the pending Lock to queue its key
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp, err := client.Client.Get(ctx, waiter.Key())
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		if resp.Count > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("waiter key not queued")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := waiter.TryLock(ctx); err != ErrETCD_Locked {
+		t.Fatalf("TryLock during Lock = %v, want ErrETCD_Locked", err)
+	}
+	if err := waiter.Lock(ctx); err != ErrETCD_Locked {
+		t.Fatalf("second Lock during Lock = %v, want ErrETCD_Locked", err)
+	}
+
+	// TryLock must not have removed the key of the pending Lock
+	resp, err := client.Client.Get(ctx, waiter.Key())
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if resp.Count != 1 {
+		t.Fatalf("waiter key %s removed by TryLock", waiter.Key())
+	}
+
+	if err := holder.Unlock(ctx); err != nil {
+		t.Fatalf("holder Unlock: %v", err)
+	}
+
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Fatalf("waiter Lock: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("waiter not granted the lock after Unlock")
+	}
+
+	if !waiter.Locked() {
+		t.Fatal("waiter Locked = false")
+	}
+}
@@ -0,0 +1,323 @@
+package ETCD
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"sync"
+
+	Const "iparking/share/const"
+
+	etcd "github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+)
+
+type ETCDEventType int
+
+const (
+	ETCDEvent_Put ETCDEventType = iota
+	ETCDEvent_Delete
+)
+
+func (this ETCDEventType) String() string {
+	if this == ETCDEvent_Delete {
+		return "DELETE"
+	}
+	return "PUT"
+}
+
+// ETCDEvent change of one key under a registered prefix. Value is nil on delete
+type ETCDEvent struct {
+	Key      string
+	Suffix   string
+	Type     ETCDEventType
+	Value    interface{}
+	Revision int64
+}
+
+// ETCDPrefix tree of configs stored under Prefix, keyed by the suffix after Prefix
+type ETCDPrefix struct {
+	Prefix string
+	Type   reflect.Type
+
+	// Decode optional decoder replacing json into Type
+	Decode func(data []byte) (interface{}, error)
+
+	open        func(data []byte) ([]byte, error)
+	entries     map[string]*ETCDConfig
+	revision    int64
+	subscribers []func(ETCDEvent)
+	batches     []func([]ETCDEvent)
+	lock        sync.RWMutex
+}
+
+// Get config of suffix, nil when missing
+func (this *ETCDPrefix) Get(suffix string) interface{} {
+
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	if config, ok := this.entries[suffix]; ok {
+		return config.Content()
+	}
+
+	return nil
+}
+
+// RevisionOf ModRevision of suffix, used as the expected revision of CompareAndSet. 0 when missing
+func (this *ETCDPrefix) RevisionOf(suffix string) int64 {
+
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	if config, ok := this.entries[suffix]; ok {
+		return config.Revision()
+	}
+
+	return 0
+}
+
+// Values snapshot of every config, keyed by suffix
+func (this *ETCDPrefix) Values() map[string]interface{} {
+
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	values := make(map[string]interface{}, len(this.entries))
+	for suffix, config := range this.entries {
+		values[suffix] = config.Content()
+	}
+
+	return values
+}
+
+// Revision etcd revision the tree is up to date with
+func (this *ETCDPrefix) Revision() int64 {
+
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	return this.revision
+}
+
+// Subscribe call fn on every put or delete under Prefix, after the tree is updated
+func (this *ETCDPrefix) Subscribe(fn func(ETCDEvent)) {
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.subscribers = append(this.subscribers, fn)
+}
+
+// SubscribeBatch call fn once with the events of every watch response or reload which changed something
+func (this *ETCDPrefix) SubscribeBatch(fn func(events []ETCDEvent)) {
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.batches = append(this.batches, fn)
+}
+
+func (this *ETCDPrefix) decode(data []byte) (interface{}, error) {
+	config := ETCDConfig{Type: this.Type, Decode: this.Decode, open: this.open}
+	return config.decode(data)
+}
+
+// load replace the whole tree by kvs read at revision, returning the events of what changed
+func (this *ETCDPrefix) load(kvs []*mvccpb.KeyValue, revision int64) []ETCDEvent {
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	events := []ETCDEvent{}
+	seen := make(map[string]bool, len(kvs))
+
+	for _, kv := range kvs {
+		key := string(kv.Key)
+		suffix := strings.TrimPrefix(key, this.Prefix)
+		seen[suffix] = true
+
+		if config, ok := this.entries[suffix]; ok && config.Revision() == kv.ModRevision {
+			continue
+		}
+
+		if event, ok := this.put(key, suffix, kv); ok {
+			events = append(events, event)
+		}
+	}
+
+	for suffix, config := range this.entries {
+		if seen[suffix] {
+			continue
+		}
+		delete(this.entries, suffix)
+		events = append(events, ETCDEvent{Key: config.Key, Suffix: suffix, Type: ETCDEvent_Delete, Revision: revision})
+	}
+
+	this.revision = revision
+	return events
+}
+
+// apply update the tree with one watch event
+func (this *ETCDPrefix) apply(ev *etcd.Event) (ETCDEvent, bool) {
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	key := string(ev.Kv.Key)
+	suffix := strings.TrimPrefix(key, this.Prefix)
+
+	if ev.Kv.ModRevision > this.revision {
+		this.revision = ev.Kv.ModRevision
+	}
+
+	if ev.Type == mvccpb.DELETE {
+		if _, ok := this.entries[suffix]; !ok {
+			return ETCDEvent{}, false
+		}
+		delete(this.entries, suffix)
+		return ETCDEvent{Key: key, Suffix: suffix, Type: ETCDEvent_Delete, Revision: ev.Kv.ModRevision}, true
+	}
+
+	return this.put(key, suffix, ev.Kv)
+}
+
+// put decode kv into the entry of suffix. Undecodable values keep the previous entry
+func (this *ETCDPrefix) put(key string, suffix string, kv *mvccpb.KeyValue) (ETCDEvent, bool) {
+
+	value, err := this.decode(kv.Value)
+	if err != nil {
+		return ETCDEvent{}, false
+	}
+
+	config, ok := this.entries[suffix]
+	if !ok {
+		config = &ETCDConfig{Key: key, Type: this.Type, Decode: this.Decode, open: this.open}
+		this.entries[suffix] = config
+	}
+
+	if !config.store(value, kv.ModRevision) {
+		return ETCDEvent{}, false
+	}
+
+	return ETCDEvent{Key: key, Suffix: suffix, Type: ETCDEvent_Put, Value: value, Revision: kv.ModRevision}, true
+}
+
+func (this *ETCDPrefix) notify(events []ETCDEvent) {
+
+	this.lock.RLock()
+	subscribers := append([]func(ETCDEvent){}, this.subscribers...)
+	batches := append([]func([]ETCDEvent){}, this.batches...)
+	this.lock.RUnlock()
+
+	for _, event := range events {
+		for _, fn := range subscribers {
+			fn(event)
+		}
+	}
+
+	if len(events) == 0 {
+		return
+	}
+
+	for _, fn := range batches {
+		fn(events)
+	}
+}
+
+// RegisterPrefix register every key under prefix and load them
+func (this *ETCDClient) RegisterPrefix(prefix string, objType reflect.Type) (*ETCDPrefix, error) {
+
+	tree := &ETCDPrefix{
+		Prefix:  prefix,
+		Type:    objType,
+		open:    this.openSecrets,
+		entries: make(map[string]*ETCDConfig),
+	}
+
+	this.lock.Lock()
+	if this.prefixes == nil {
+		this.prefixes = make(map[string]*ETCDPrefix)
+	}
+	this.prefixes[prefix] = tree
+	this.lock.Unlock()
+
+	if err := this.RefreshPrefix(prefix); err != nil {
+		return tree, err
+	}
+
+	return tree, nil
+}
+
+// Prefix registered tree of prefix, nil when prefix is not registered
+func (this *ETCDClient) Prefix(prefix string) *ETCDPrefix {
+
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	return this.prefixes[prefix]
+}
+
+// Prefixes registered prefixes
+func (this *ETCDClient) Prefixes() []string {
+
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	prefixes := make([]string, 0, len(this.prefixes))
+	for prefix := range this.prefixes {
+		prefixes = append(prefixes, prefix)
+	}
+
+	return prefixes
+}
+
+// RefreshPrefix re-read every key under prefix, subscribers are notified of what changed
+func (this *ETCDClient) RefreshPrefix(prefix string) error {
+
+	tree := this.Prefix(prefix)
+	if tree == nil {
+		return Const.ErrETCD_NotFoundKey
+	}
+
+	resp, err := this.kvClient().Get(this.Context, prefix, etcd.WithPrefix())
+	if err != nil {
+		return err
+	}
+
+	tree.notify(tree.load(resp.Kvs, resp.Header.Revision))
+	return nil
+}
+
+// WatchPrefix apply puts and deletes under prefix as they happen, starting after the loaded revision.
+// Returns nil when prefix is not registered
+func (this *ETCDClient) WatchPrefix(prefix string) *ETCDWatcher {
+
+	tree := this.Prefix(prefix)
+	if tree == nil {
+		return nil
+	}
+
+	watcher := &ETCDWatcher{
+		Key:      prefix,
+		Prefix:   true,
+		revision: tree.Revision(),
+		reload: func() (int64, error) {
+			if err := this.RefreshPrefix(prefix); err != nil {
+				return 0, err
+			}
+			return tree.Revision(), nil
+		},
+		handle: func(ctx context.Context, events []*etcd.Event) {
+			applied := []ETCDEvent{}
+			for _, ev := range events {
+				if event, ok := tree.apply(ev); ok {
+					applied = append(applied, event)
+				}
+			}
+			tree.notify(applied)
+		},
+	}
+
+	return this.startWatcher("prefix:"+prefix, watcher)
+}
@@ -0,0 +1,259 @@
+package ETCD
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	GRPC "iparking/share/libs/grpc"
+	Logger "iparking/share/libs/logger"
+
+	etcd "github.com/coreos/etcd/clientv3"
+)
+
+// ETCDServiceInstance one running instance of a service, stored under <prefix>/<Service>/<ID>
+type ETCDServiceInstance struct {
+	Service      string            `json:"service"`
+	ID           string            `json:"id"`
+	Address      string            `json:"address"`
+	Metadata     map[string]string `json:"metadata,omitempty"`
+	RegisteredAt int64             `json:"registeredAt"`
+}
+
+// ETCDRegistration leased registry key of an instance, kept alive until Deregister
+type ETCDRegistration struct {
+	Key      string
+	Instance ETCDServiceInstance
+
+	client      *etcd.Client
+	ttlInSecond int64
+	lease       etcd.LeaseID
+	cancel      context.CancelFunc
+	done        chan struct{}
+	lock        sync.Mutex
+}
+
+// RegisterService write instance under prefix with a lease of ttlInSecond, and keep it alive with
+// heartbeats. The key is written again when the lease is lost, e.g. after a long partition
+func (this *ETCDClient) RegisterService(prefix string, instance ETCDServiceInstance, ttlInSecond int64) (*ETCDRegistration, error) {
+
+	client, err := this.leaseClient()
+	if err != nil {
+		return nil, err
+	}
+
+	if instance.RegisteredAt == 0 {
+		instance.RegisteredAt = time.Now().UnixNano()
+	}
+
+	registration := &ETCDRegistration{
+		Key:         fmt.Sprintf("%s/%s/%s", strings.TrimSuffix(prefix, "/"), instance.Service, instance.ID),
+		Instance:    instance,
+		client:      client,
+		ttlInSecond: ttlInSecond,
+		done:        make(chan struct{}),
+	}
+
+	ctx, cancel := context.WithCancel(this.Context)
+	registration.cancel = cancel
+
+	keepalive, err := registration.register(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	go registration.heartbeat(ctx, keepalive)
+	return registration, nil
+}
+
+// Deregister stop heartbeats and remove the key
+func (this *ETCDRegistration) Deregister(ctx context.Context) error {
+
+	this.cancel()
+	<-this.done
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	_, err := this.client.Revoke(ctx, this.lease)
+	return err
+}
+
+func (this *ETCDRegistration) register(ctx context.Context) (<-chan *etcd.LeaseKeepAliveResponse, error) {
+
+	data, err := json.Marshal(this.Instance)
+	if err != nil {
+		return nil, err
+	}
+
+	lease, err := this.client.Grant(ctx, this.ttlInSecond)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = this.client.Put(ctx, this.Key, string(data), etcd.WithLease(lease.ID)); err != nil {
+		return nil, err
+	}
+
+	this.lock.Lock()
+	this.lease = lease.ID
+	this.lock.Unlock()
+
+	return this.client.KeepAlive(ctx, lease.ID)
+}
+
+func (this *ETCDRegistration) heartbeat(ctx context.Context, keepalive <-chan *etcd.LeaseKeepAliveResponse) {
+
+	defer close(this.done)
+
+	backoff := etcdWatchMinBackoff
+
+	for {
+		for range keepalive {
+		}
+
+		// keepalive closes when ctx is done or the lease could not be renewed
+		for {
+			if ctx.Err() != nil {
+				return
+			}
+
+			Logger.WriteLog("ETCD registration of " + this.Key + " lost its lease, registering again")
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+
+			var err error
+			if keepalive, err = this.register(ctx); err == nil {
+				backoff = etcdWatchMinBackoff
+				break
+			}
+
+			if backoff *= 2; backoff > etcdWatchMaxBackoff {
+				backoff = etcdWatchMaxBackoff
+			}
+		}
+	}
+}
+
+// ETCDDiscovery watch the registry under Prefix and keep GRPC connected to one live instance per service
+type ETCDDiscovery struct {
+	Prefix string
+	GRPC   *GRPC.GRPCClient
+
+	// OnChange optional, called with the live endpoints after GRPC was updated
+	OnChange func(services map[string]string)
+
+	client  *ETCDClient
+	tree    *ETCDPrefix
+	watcher *ETCDWatcher
+	stopped bool
+	lock    sync.Mutex
+}
+
+// Discover load the registry under prefix, connect grpc to it, and follow its changes
+func (this *ETCDClient) Discover(prefix string, grpc *GRPC.GRPCClient) (*ETCDDiscovery, error) {
+
+	prefix = strings.TrimSuffix(prefix, "/") + "/"
+
+	tree, err := this.RegisterPrefix(prefix, reflect.TypeOf(ETCDServiceInstance{}))
+	if err != nil {
+		return nil, err
+	}
+
+	// one sync per watch response, a response often carries several instances
+	discovery := &ETCDDiscovery{Prefix: prefix, GRPC: grpc, client: this, tree: tree}
+	tree.SubscribeBatch(func(events []ETCDEvent) {
+		discovery.sync()
+	})
+
+	discovery.sync()
+	discovery.watcher = this.WatchPrefix(prefix)
+
+	return discovery, nil
+}
+
+// Stop stop following the registry, connections are left open
+func (this *ETCDDiscovery) Stop() {
+
+	this.lock.Lock()
+	this.stopped = true
+	this.lock.Unlock()
+
+	this.client.stopWatcher("prefix:"+this.Prefix, this.watcher)
+}
+
+// Instances live instances of service, oldest first
+func (this *ETCDDiscovery) Instances(service string) []ETCDServiceInstance {
+
+	instances := []ETCDServiceInstance{}
+	for _, value := range this.tree.Values() {
+		if instance, ok := value.(*ETCDServiceInstance); ok && instance.Service == service {
+			instances = append(instances, *instance)
+		}
+	}
+
+	sort.Slice(instances, func(i, j int) bool {
+		if instances[i].RegisteredAt != instances[j].RegisteredAt {
+			return instances[i].RegisteredAt < instances[j].RegisteredAt
+		}
+		return instances[i].ID < instances[j].ID
+	})
+
+	return instances
+}
+
+// Services address of every live service. With several instances the oldest one is used,
+// so a new replica does not move traffic until the current one leaves
+func (this *ETCDDiscovery) Services() map[string]string {
+
+	oldest := make(map[string]*ETCDServiceInstance)
+	for _, value := range this.tree.Values() {
+		instance, ok := value.(*ETCDServiceInstance)
+		if !ok {
+			continue
+		}
+
+		current, ok := oldest[instance.Service]
+		if !ok || instance.RegisteredAt < current.RegisteredAt ||
+			(instance.RegisteredAt == current.RegisteredAt && instance.ID < current.ID) {
+			oldest[instance.Service] = instance
+		}
+	}
+
+	services := make(map[string]string, len(oldest))
+	for name, instance := range oldest {
+		services[name] = instance.Address
+	}
+
+	return services
+}
+
+func (this *ETCDDiscovery) sync() {
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.stopped {
+		return
+	}
+
+	services := this.Services()
+
+	if this.GRPC != nil {
+		this.GRPC.ConnectAll(services)
+	}
+
+	if this.OnChange != nil {
+		this.OnChange(services)
+	}
+}
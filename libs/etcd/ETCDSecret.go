@@ -0,0 +1,202 @@
+package ETCD
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"iparking/share/libs/crypto/ECDH"
+	"iparking/share/libs/crypto/PPKeyTransform"
+)
+
+// ETCDSecretPrefix marks a JSON string holding an encrypted value: ETCDSecretPrefix + base64(ciphertext).
+// The ciphertext is the JSON encoding of the original value, so any field type can be a secret
+const ETCDSecretPrefix = "ecdh:"
+
+var (
+	ErrETCD_NoSecretKey     = errors.New("etcd value has encrypted fields but no secret key is set")
+	ErrETCD_SecretNotFound  = errors.New("etcd secret field not found in value")
+	ErrETCD_SecretMalformed = errors.New("etcd secret field is malformed")
+)
+
+// SetSecretKey private key, in the format read by PPKeyTransform.ECDSA_PrivateKey, decrypting secret
+// fields on every Refresh and watch update. Its public half is used by EncryptFields
+func (this *ETCDClient) SetSecretKey(der []byte) error {
+
+	key, err := PPKeyTransform.ECDSA_PrivateKey(der)
+	if err != nil {
+		return err
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.secretKey = key
+	return nil
+}
+
+// EncryptFields value as JSON with the fields at paths encrypted for the client secret key, ready for Put
+func (this *ETCDClient) EncryptFields(value interface{}, paths ...string) (json.RawMessage, error) {
+
+	this.lock.RLock()
+	key := this.secretKey
+	this.lock.RUnlock()
+
+	if key == nil {
+		return nil, ErrETCD_NoSecretKey
+	}
+
+	return EncryptFields(&key.PublicKey, value, paths...)
+}
+
+// EncryptFields value as JSON with the fields at paths encrypted for pub. A path names JSON keys from the
+// root, separated by dots, e.g. "DB.Password"
+func EncryptFields(pub *ecdsa.PublicKey, value interface{}, paths ...string) (json.RawMessage, error) {
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc interface{}
+	if err = unmarshalNumber(data, &doc); err != nil {
+		return nil, err
+	}
+
+	for _, path := range paths {
+
+		parent, ok := doc.(map[string]interface{})
+		keys := strings.Split(path, ".")
+
+		for _, key := range keys[:len(keys)-1] {
+			if !ok {
+				break
+			}
+			parent, ok = parent[key].(map[string]interface{})
+		}
+
+		last := keys[len(keys)-1]
+		if !ok {
+			return nil, ErrETCD_SecretNotFound
+		}
+		if _, found := parent[last]; !found {
+			return nil, ErrETCD_SecretNotFound
+		}
+
+		if parent[last], err = Seal(pub, parent[last]); err != nil {
+			return nil, err
+		}
+	}
+
+	return json.Marshal(doc)
+}
+
+// Seal encrypt value for pub into a secret field string
+func Seal(pub *ecdsa.PublicKey, value interface{}) (string, error) {
+
+	plain, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+
+	cipher, err := ECDH.Encrypt_ECDHE_ECDSA_AES256_GCM_HMAC_SHA1(pub, plain)
+	if err != nil {
+		return "", err
+	}
+
+	return ETCDSecretPrefix + base64.StdEncoding.EncodeToString(cipher), nil
+}
+
+// openSecrets replace every secret field of data by its decrypted value
+func (this *ETCDClient) openSecrets(data []byte) ([]byte, error) {
+
+	if !bytes.Contains(data, []byte(`"`+ETCDSecretPrefix)) {
+		return data, nil
+	}
+
+	this.lock.RLock()
+	key := this.secretKey
+	this.lock.RUnlock()
+
+	var doc interface{}
+	if err := unmarshalNumber(data, &doc); err != nil {
+		return nil, err
+	}
+
+	opened, changed, err := openValue(key, doc)
+	if err != nil || !changed {
+		return data, err
+	}
+
+	return json.Marshal(opened)
+}
+
+func openValue(key *ecdsa.PrivateKey, doc interface{}) (interface{}, bool, error) {
+
+	switch value := doc.(type) {
+
+	case string:
+		if !strings.HasPrefix(value, ETCDSecretPrefix) {
+			return value, false, nil
+		}
+		if key == nil {
+			return nil, false, ErrETCD_NoSecretKey
+		}
+
+		cipher, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, ETCDSecretPrefix))
+		if err != nil {
+			return nil, false, ErrETCD_SecretMalformed
+		}
+
+		plain, err := ECDH.Decrypt_ECDHE_ECDSA_AES256_GCM_HMAC_SHA1(key, cipher)
+		if err != nil {
+			return nil, false, err
+		}
+
+		var opened interface{}
+		if err = unmarshalNumber(plain, &opened); err != nil {
+			return nil, false, ErrETCD_SecretMalformed
+		}
+		return opened, true, nil
+
+	case map[string]interface{}:
+		changed := false
+		for k, v := range value {
+			opened, ok, err := openValue(key, v)
+			if err != nil {
+				return nil, false, err
+			}
+			if ok {
+				value[k] = opened
+				changed = true
+			}
+		}
+		return value, changed, nil
+
+	case []interface{}:
+		changed := false
+		for i, v := range value {
+			opened, ok, err := openValue(key, v)
+			if err != nil {
+				return nil, false, err
+			}
+			if ok {
+				value[i] = opened
+				changed = true
+			}
+		}
+		return value, changed, nil
+	}
+
+	return doc, false, nil
+}
+
+// unmarshalNumber keep numbers as json.Number so large integers survive the round trip
+func unmarshalNumber(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
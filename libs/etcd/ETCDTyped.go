@@ -0,0 +1,77 @@
+package ETCD
+
+import (
+	"encoding/json"
+	"reflect"
+)
+
+// Validator implemented by config types which check themselves before replacing the current value
+type Validator interface {
+	Validate() error
+}
+
+// ETCDValue typed config of one key. Load always returns the last value which decoded and validated,
+// an invalid update in etcd is rejected and the previous value kept
+type ETCDValue[T any] struct {
+	Key    string
+	config *ETCDConfig
+}
+
+// RegisterTyped register key decoding its JSON straight into T, and load it. The handle is kept up to
+// date by WatchAll. When the key is missing the handle stays empty (Loaded returns false). A key
+// registered again shares its config with the earlier handles, ErrETCD_TypeMismatch when it is not a T
+func RegisterTyped[T any](client *ETCDClient, key string) (*ETCDValue[T], error) {
+
+	config, err := client.register(&ETCDConfig{
+		Key:    key,
+		Type:   reflect.TypeOf((*T)(nil)).Elem(),
+		Decode: decodeTyped[T],
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	handle := &ETCDValue[T]{Key: key, config: config}
+	if _, err := client.Refresh(key); err != nil {
+		return handle, err
+	}
+
+	return handle, nil
+}
+
+func decodeTyped[T any](data []byte) (interface{}, error) {
+
+	obj := new(T)
+	if err := json.Unmarshal(data, obj); err != nil {
+		return nil, err
+	}
+
+	if validator, ok := interface{}(obj).(Validator); ok {
+		if err := validator.Validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	return obj, nil
+}
+
+// Load last valid value, zero value when nothing was loaded yet. Safe for concurrent use
+func (this *ETCDValue[T]) Load() T {
+
+	if obj, ok := this.config.Content().(*T); ok {
+		return *obj
+	}
+
+	var zero T
+	return zero
+}
+
+// Loaded whether a valid value was loaded
+func (this *ETCDValue[T]) Loaded() bool {
+	return this.config.Loaded()
+}
+
+// Revision etcd ModRevision of the loaded value
+func (this *ETCDValue[T]) Revision() int64 {
+	return this.config.Revision()
+}
@@ -0,0 +1,227 @@
+package ETCD
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	Logger "iparking/share/libs/logger"
+
+	etcd "github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+)
+
+type ETCDWatchState int32
+
+const (
+	ETCDWatch_Connected ETCDWatchState = iota
+	ETCDWatch_Retrying
+	ETCDWatch_Stopped
+)
+
+func (this ETCDWatchState) String() string {
+	switch this {
+	case ETCDWatch_Connected:
+		return "connected"
+	case ETCDWatch_Retrying:
+		return "retrying"
+	}
+	return "stopped"
+}
+
+var (
+	ErrETCD_WatchClosed = errors.New("etcd watch channel closed")
+	ErrETCD_WatchPanic  = errors.New("etcd watch handler panic")
+)
+
+const (
+	etcdWatchMinBackoff = 500 * time.Millisecond
+	etcdWatchMaxBackoff = 30 * time.Second
+)
+
+// ETCDWatcher supervised watch of one key or prefix. It resumes from the last seen revision after a
+// disconnect, re-reads everything when that revision was compacted, and backs off between retries
+type ETCDWatcher struct {
+	Key    string
+	Prefix bool
+
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// OnState called on every state change, err is the cause of a retry
+	OnState func(watcher *ETCDWatcher, state ETCDWatchState, err error)
+
+	client   *ETCDClient
+	reload   func() (int64, error)
+	handle   func(ctx context.Context, events []*etcd.Event)
+	state    int32
+	revision int64
+	lastErr  atomic.Value
+	cancel   context.CancelFunc
+	done     chan struct{}
+	once     sync.Once
+}
+
+// State current state of the watcher
+func (this *ETCDWatcher) State() ETCDWatchState {
+	return ETCDWatchState(atomic.LoadInt32(&this.state))
+}
+
+// Revision last revision the watcher has applied
+func (this *ETCDWatcher) Revision() int64 {
+	return atomic.LoadInt64(&this.revision)
+}
+
+// Err cause of the last retry, nil when none
+func (this *ETCDWatcher) Err() error {
+	err, _ := this.lastErr.Load().(error)
+	return err
+}
+
+// Stop cancel the watch and wait for it to finish
+func (this *ETCDWatcher) Stop() {
+
+	this.once.Do(func() {
+		if this.cancel != nil {
+			this.cancel()
+		}
+	})
+
+	if this.done != nil {
+		<-this.done
+	}
+}
+
+func (this *ETCDWatcher) start(ctx context.Context) {
+
+	ctx, this.cancel = context.WithCancel(ctx)
+	this.done = make(chan struct{})
+	atomic.StoreInt32(&this.state, int32(ETCDWatch_Retrying))
+
+	go this.run(ctx)
+}
+
+func (this *ETCDWatcher) run(ctx context.Context) {
+
+	defer close(this.done)
+	defer this.setState(ETCDWatch_Stopped, nil)
+
+	backoff := this.minBackoff()
+	reload := this.Revision() == 0
+
+	for {
+		var err error
+
+		if reload {
+			var revision int64
+			if revision, err = this.reload(); err == nil {
+				atomic.StoreInt64(&this.revision, revision)
+				reload = false
+			}
+		}
+
+		if err == nil {
+			revision := this.Revision()
+			err = this.watch(ctx)
+			if err == rpctypes.ErrCompacted {
+				reload = true
+			}
+			if this.Revision() > revision {
+				backoff = this.minBackoff()
+			}
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		this.setState(ETCDWatch_Retrying, err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		if backoff *= 2; backoff > this.maxBackoff() {
+			backoff = this.maxBackoff()
+		}
+	}
+}
+
+// watch stream events from the last revision until the watch channel fails or closes
+func (this *ETCDWatcher) watch(ctx context.Context) (err error) {
+
+	defer func() {
+		if e := recover(); e != nil {
+			Logger.WriteLog(fmt.Sprintf("ETCD watcher %s panic: %v", this.Key, e))
+			err = ErrETCD_WatchPanic
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	opts := []etcd.OpOption{etcd.WithRev(this.Revision() + 1), etcd.WithCreatedNotify()}
+	if this.Prefix {
+		opts = append(opts, etcd.WithPrefix())
+	}
+
+	// connected only once etcd has created the watch; without a leader the watch is closed with
+	// ErrNoLeader instead of hanging on a member cut off from the quorum
+	watchan := this.client.watchClient().Watch(etcd.WithRequireLeader(ctx), this.Key, opts...)
+
+	for resp := range watchan {
+		if err := resp.Err(); err != nil {
+			return err
+		}
+
+		if resp.Created {
+			this.setState(ETCDWatch_Connected, nil)
+		}
+
+		if len(resp.Events) > 0 {
+			this.handle(ctx, resp.Events)
+			atomic.StoreInt64(&this.revision, resp.Events[len(resp.Events)-1].Kv.ModRevision)
+		}
+
+		if resp.Canceled {
+			return ErrETCD_WatchClosed
+		}
+	}
+
+	return ErrETCD_WatchClosed
+}
+
+func (this *ETCDWatcher) setState(state ETCDWatchState, err error) {
+
+	if err != nil {
+		this.lastErr.Store(err)
+	}
+
+	old := ETCDWatchState(atomic.SwapInt32(&this.state, int32(state)))
+	if old == state && err == nil {
+		return
+	}
+
+	if this.OnState != nil {
+		this.OnState(this, state, err)
+	}
+}
+
+func (this *ETCDWatcher) minBackoff() time.Duration {
+	if this.MinBackoff > 0 {
+		return this.MinBackoff
+	}
+	return etcdWatchMinBackoff
+}
+
+func (this *ETCDWatcher) maxBackoff() time.Duration {
+	if this.MaxBackoff > 0 {
+		return this.MaxBackoff
+	}
+	return etcdWatchMaxBackoff
+}
@@ -0,0 +1,155 @@
+package ETCD
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+
+	Const "iparking/share/const"
+
+	etcd "github.com/coreos/etcd/clientv3"
+)
+
+var (
+	ErrETCD_RevisionConflict = errors.New("etcd key was modified since the expected revision")
+)
+
+// ETCDPutOptions options of Put. With CompareRevision the write only succeeds when the key ModRevision
+// still equals Revision, Revision 0 meaning the key must not exist yet
+type ETCDPutOptions struct {
+	CompareRevision bool
+	Revision        int64
+	TTLInSecond     int64
+}
+
+// Set marshal value to JSON and put it under a registered key, returning the new revision
+func (this *ETCDClient) Set(key string, value interface{}) (int64, error) {
+	return this.Put(key, value, ETCDPutOptions{})
+}
+
+// CompareAndSet Set only when the key is still at revision, ErrETCD_RevisionConflict otherwise
+func (this *ETCDClient) CompareAndSet(key string, value interface{}, revision int64) (int64, error) {
+	return this.Put(key, value, ETCDPutOptions{CompareRevision: true, Revision: revision})
+}
+
+// Put marshal value to JSON and write it under a registered key. Values implementing Validator are
+// validated first. The local cache of the key is updated on success
+func (this *ETCDClient) Put(key string, value interface{}, opts ETCDPutOptions) (revision int64, err error) {
+
+	if !this.registered(key) {
+		return 0, Const.ErrETCD_NotFoundKey
+	}
+
+	if validator, ok := value.(Validator); ok {
+		if err := validator.Validate(); err != nil {
+			return 0, err
+		}
+	}
+
+	var data []byte
+	if data, err = json.Marshal(value); err != nil {
+		return 0, err
+	}
+
+	putOpts := []etcd.OpOption{}
+	if opts.TTLInSecond > 0 {
+		leases, leaseErr := this.leaseClient()
+		if leaseErr != nil {
+			return 0, leaseErr
+		}
+
+		lease, grantErr := leases.Grant(this.Context, opts.TTLInSecond)
+		if grantErr != nil {
+			return 0, grantErr
+		}
+		putOpts = append(putOpts, etcd.WithLease(lease.ID))
+
+		// named err holds whatever the write returns, drop the lease when nothing was written
+		defer func() {
+			if err != nil {
+				leases.Revoke(this.Context, lease.ID)
+			}
+		}()
+	}
+
+	if opts.CompareRevision {
+		var resp *etcd.TxnResponse
+		resp, err = this.kvClient().Txn(this.Context).
+			If(etcd.Compare(etcd.ModRevision(key), "=", opts.Revision)).
+			Then(etcd.OpPut(key, string(data), putOpts...)).
+			Commit()
+		if err != nil {
+			return 0, err
+		}
+		if !resp.Succeeded {
+			return 0, ErrETCD_RevisionConflict
+		}
+		revision = resp.Header.Revision
+	} else {
+		var resp *etcd.PutResponse
+		if resp, err = this.kvClient().Put(this.Context, key, string(data), putOpts...); err != nil {
+			return 0, err
+		}
+		revision = resp.Header.Revision
+	}
+
+	if config := this.Config(key); config != nil {
+		if obj, err := config.decode(data); err == nil {
+			config.store(obj, revision)
+		}
+	}
+
+	return revision, nil
+}
+
+// Delete remove a registered key. The cached value is kept until the key is put again
+func (this *ETCDClient) Delete(key string) error {
+
+	if !this.registered(key) {
+		return Const.ErrETCD_NotFoundKey
+	}
+
+	_, err := this.kvClient().Delete(this.Context, key)
+	return err
+}
+
+// CompareAndDelete Delete only when the key is still at revision, ErrETCD_RevisionConflict otherwise
+func (this *ETCDClient) CompareAndDelete(key string, revision int64) error {
+
+	if !this.registered(key) {
+		return Const.ErrETCD_NotFoundKey
+	}
+
+	resp, err := this.kvClient().Txn(this.Context).
+		If(etcd.Compare(etcd.ModRevision(key), "=", revision)).
+		Then(etcd.OpDelete(key)).
+		Commit()
+	if err != nil {
+		return err
+	}
+
+	if !resp.Succeeded {
+		return ErrETCD_RevisionConflict
+	}
+
+	return nil
+}
+
+// registered whether key was registered, alone or under a registered prefix
+func (this *ETCDClient) registered(key string) bool {
+
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	if _, ok := this.configs[key]; ok {
+		return true
+	}
+
+	for prefix := range this.prefixes {
+		if strings.HasPrefix(key, prefix) && len(key) > len(prefix) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,454 @@
+package ETCD
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	Const "iparking/share/const"
+	ETCDTest "iparking/share/libs/etcd/etcdtest"
+	GRPC "iparking/share/libs/grpc"
+
+	etcd "github.com/coreos/etcd/clientv3"
+	"google.golang.org/grpc"
+)
+
+type fakeSetting struct {
+	N int `json:"n"`
+}
+
+func newFakeClient(t *testing.T) (*ETCDClient, *ETCDTest.FakeETCD) {
+
+	fake := ETCDTest.NewFakeETCD()
+	client := &ETCDClient{}
+	client.InitWith(fake, fake)
+
+	t.Cleanup(client.StopWatch)
+
+	return client, fake
+}
+
+func putSetting(t *testing.T, fake *ETCDTest.FakeETCD, key string, n int) {
+
+	if _, err := fake.Put(context.Background(), key, fmt.Sprintf(`{"n":%d}`, n)); err != nil {
+		t.Errorf("Put %s: %v", key, err)
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestETCDClient_ConcurrentAccess(t *testing.T) {
+
+	client, fake := newFakeClient(t)
+
+	keys := []string{"cfg/a", "cfg/b", "cfg/c", "cfg/d"}
+	for _, key := range keys {
+		putSetting(t, fake, key, 0)
+	}
+
+	var wg sync.WaitGroup
+	run := func(fn func(i int)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				fn(i)
+			}
+		}()
+	}
+
+	for _, key := range keys {
+		key := key
+
+		run(func(i int) {
+			if i%50 == 0 {
+				client.Register(key, reflect.TypeOf(fakeSetting{}))
+			}
+		})
+		run(func(i int) { putSetting(t, fake, key, i) })
+		run(func(i int) {
+			if _, err := client.Refresh(key); err != nil && err != Const.ErrETCD_NotFoundKey {
+				t.Errorf("Refresh %s: %v", key, err)
+			}
+		})
+		run(func(i int) {
+			if value := client.Get(key); value != nil {
+				if _, ok := value.(*fakeSetting); !ok {
+					t.Errorf("Get %s = %T", key, value)
+				}
+			}
+		})
+		run(func(i int) {
+			if config := client.Config(key); config != nil {
+				config.store(&fakeSetting{}, 1)
+			}
+		})
+	}
+
+	run(func(i int) {
+		client.Register(fmt.Sprintf("cfg/extra/%d", i), reflect.TypeOf(fakeSetting{}))
+		client.Keys()
+	})
+
+	wg.Wait()
+
+	if got := len(client.Keys()); got != len(keys)+200 {
+		t.Fatalf("Keys = %d, want %d", got, len(keys)+200)
+	}
+
+	for _, key := range keys {
+		value, err := client.Refresh(key)
+		if err != nil {
+			t.Fatalf("Refresh %s: %v", key, err)
+		}
+
+		resp, _ := fake.Get(context.Background(), key)
+		if got := client.Config(key).Revision(); got != resp.Kvs[0].ModRevision {
+			t.Fatalf("%s revision = %d, want %d", key, got, resp.Kvs[0].ModRevision)
+		}
+
+		if value.(*fakeSetting).N != 199 {
+			t.Fatalf("%s = %+v, want 199", key, value)
+		}
+	}
+}
+
+func TestETCDClient_RegisterAgain(t *testing.T) {
+
+	client, fake := newFakeClient(t)
+	putSetting(t, fake, "cfg/again", 1)
+
+	config, err := client.RegisterConfig("cfg/again", reflect.TypeOf(fakeSetting{}))
+	if err != nil {
+		t.Fatalf("RegisterConfig: %v", err)
+	}
+
+	notified := make(chan int, 4)
+	config.Subscribe(func(value interface{}, revision int64) {
+		notified <- value.(*fakeSetting).N
+	})
+
+	if value := client.Register("cfg/again", reflect.TypeOf(fakeSetting{})); value.(*fakeSetting).N != 1 {
+		t.Fatalf("Register again = %+v, want 1", value)
+	}
+	if client.Config("cfg/again") != config {
+		t.Fatal("Register again replaced the config")
+	}
+
+	if _, err := client.RegisterConfig("cfg/again", reflect.TypeOf("")); !errors.Is(err, ErrETCD_TypeMismatch) {
+		t.Fatalf("RegisterConfig with another type = %v, want ErrETCD_TypeMismatch", err)
+	}
+	if _, err := RegisterTyped[string](client, "cfg/again"); !errors.Is(err, ErrETCD_TypeMismatch) {
+		t.Fatalf("RegisterTyped with another type = %v, want ErrETCD_TypeMismatch", err)
+	}
+
+	watcher := client.Watch("cfg/again")
+	waitFor(t, func() bool { return watcher.State() == ETCDWatch_Connected })
+
+	putSetting(t, fake, "cfg/again", 2)
+
+	select {
+	case n := <-notified:
+		if n != 2 {
+			t.Fatalf("subscriber saw %d, want 2", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("subscriber not called after Register again")
+	}
+}
+
+func TestETCDClient_CompareAndSet(t *testing.T) {
+
+	client, fake := newFakeClient(t)
+	client.Register("cfg/cas", reflect.TypeOf(fakeSetting{}))
+
+	created, err := client.CompareAndSet("cfg/cas", &fakeSetting{N: 1}, 0)
+	if err != nil {
+		t.Fatalf("CompareAndSet on a missing key: %v", err)
+	}
+	if _, err := client.CompareAndSet("cfg/cas", &fakeSetting{N: 2}, 0); err != ErrETCD_RevisionConflict {
+		t.Fatalf("CompareAndSet on an existing key = %v, want ErrETCD_RevisionConflict", err)
+	}
+
+	updated, err := client.CompareAndSet("cfg/cas", &fakeSetting{N: 3}, created)
+	if err != nil {
+		t.Fatalf("CompareAndSet at the current revision: %v", err)
+	}
+	if updated != fake.Revision() || client.Get("cfg/cas").(*fakeSetting).N != 3 {
+		t.Fatalf("CompareAndSet = %d with %+v, want %d with 3", updated, client.Get("cfg/cas"), fake.Revision())
+	}
+
+	if err := client.CompareAndDelete("cfg/cas", created); err != ErrETCD_RevisionConflict {
+		t.Fatalf("CompareAndDelete at an old revision = %v, want ErrETCD_RevisionConflict", err)
+	}
+	if err := client.CompareAndDelete("cfg/cas", updated); err != nil {
+		t.Fatalf("CompareAndDelete at the current revision: %v", err)
+	}
+
+	resp, _ := fake.Get(context.Background(), "cfg/cas")
+	if resp.Count != 0 {
+		t.Fatal("CompareAndDelete left the key")
+	}
+}
+
+func TestETCDClient_NoClient(t *testing.T) {
+
+	client, fake := newFakeClient(t)
+	client.Register("cfg/ttl", reflect.TypeOf(fakeSetting{}))
+
+	if _, err := client.Put("cfg/ttl", &fakeSetting{N: 1}, ETCDPutOptions{TTLInSecond: 10}); err != ErrETCD_NoClient {
+		t.Fatalf("Put with TTL = %v, want ErrETCD_NoClient", err)
+	}
+	if resp, _ := fake.Get(context.Background(), "cfg/ttl"); resp.Count != 0 {
+		t.Fatal("Put with TTL wrote without a lease")
+	}
+
+	if _, err := client.NewSession(5); err != ErrETCD_NoClient {
+		t.Fatalf("NewSession = %v, want ErrETCD_NoClient", err)
+	}
+	if _, err := client.RegisterService("/services", ETCDServiceInstance{Service: "api", ID: "1"}, 10); err != ErrETCD_NoClient {
+		t.Fatalf("RegisterService = %v, want ErrETCD_NoClient", err)
+	}
+
+	if _, err := client.Set("cfg/ttl", &fakeSetting{N: 2}); err != nil {
+		t.Fatalf("Set without TTL: %v", err)
+	}
+}
+
+func TestETCDConfig_StoreOrdering(t *testing.T) {
+
+	config := &ETCDConfig{Key: "cfg", Type: reflect.TypeOf(fakeSetting{})}
+
+	var notified []int64
+	config.Subscribe(func(value interface{}, revision int64) {
+		notified = append(notified, revision)
+	})
+
+	if !config.store(&fakeSetting{N: 1}, 5) {
+		t.Fatal("store of first revision rejected")
+	}
+	if config.store(&fakeSetting{N: 2}, 3) {
+		t.Fatal("store of older revision accepted")
+	}
+	if !config.store(&fakeSetting{N: 3}, 5) {
+		t.Fatal("store of same revision rejected")
+	}
+
+	if got := config.Content().(*fakeSetting).N; got != 3 || config.Revision() != 5 {
+		t.Fatalf("content = %d at %d, want 3 at 5", got, config.Revision())
+	}
+
+	if !reflect.DeepEqual(notified, []int64{5}) {
+		t.Fatalf("notified = %v, want [5]", notified)
+	}
+}
+
+func TestETCDClient_WatchChan(t *testing.T) {
+
+	client, fake := newFakeClient(t)
+
+	putSetting(t, fake, "cfg/watch", 0)
+	client.Register("cfg/watch", reflect.TypeOf(fakeSetting{}))
+
+	var lock sync.Mutex
+	last := 0
+	client.Config("cfg/watch").Subscribe(func(value interface{}, revision int64) {
+		lock.Lock()
+		last = value.(*fakeSetting).N
+		lock.Unlock()
+	})
+
+	watcher := client.Watch("cfg/watch")
+	waitFor(t, func() bool { return watcher.State() == ETCDWatch_Connected })
+
+	// more changes than WatchChan holds, none may be dropped
+	changes := etcdWatchChanSize * 2
+	for i := 1; i <= changes; i++ {
+		putSetting(t, fake, "cfg/watch", i)
+	}
+
+	for i := 1; i <= changes; i++ {
+		select {
+		case config := <-client.WatchChan:
+			if config.Key != "cfg/watch" {
+				t.Fatalf("WatchChan sent %s", config.Key)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("WatchChan delivered %d changes, want %d", i-1, changes)
+		}
+	}
+
+	waitFor(t, func() bool { return watcher.Revision() == fake.Revision() })
+
+	lock.Lock()
+	if last != changes {
+		t.Fatalf("subscriber saw %d, want %d", last, changes)
+	}
+	lock.Unlock()
+
+	// with nobody reading, the watcher waits on a full WatchChan and StopWatch must still return
+	for i := 1; i <= etcdWatchChanSize+1; i++ {
+		putSetting(t, fake, "cfg/watch", changes+i)
+	}
+	waitFor(t, func() bool { return len(client.WatchChan) == etcdWatchChanSize })
+
+	stopped := make(chan struct{})
+	go func() {
+		client.StopWatch()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("StopWatch blocked on an unread WatchChan")
+	}
+}
+
+// createdWatcher Watcher whose watches only report Created when told to
+type createdWatcher struct {
+	etcd.Watcher
+	created chan struct{}
+}
+
+func (this *createdWatcher) Watch(ctx context.Context, key string, opts ...etcd.OpOption) etcd.WatchChan {
+
+	watchan := make(chan etcd.WatchResponse)
+	go func() {
+		defer close(watchan)
+
+		select {
+		case <-this.created:
+		case <-ctx.Done():
+			return
+		}
+
+		select {
+		case watchan <- etcd.WatchResponse{Created: true}:
+		case <-ctx.Done():
+			return
+		}
+		<-ctx.Done()
+	}()
+
+	return watchan
+}
+
+func TestETCDWatcher_ConnectedOnCreated(t *testing.T) {
+
+	fake := ETCDTest.NewFakeETCD()
+	watch := &createdWatcher{created: make(chan struct{})}
+
+	client := &ETCDClient{}
+	client.InitWith(fake, watch)
+	t.Cleanup(client.StopWatch)
+
+	putSetting(t, fake, "cfg/created", 1)
+	client.Register("cfg/created", reflect.TypeOf(fakeSetting{}))
+
+	watcher := client.Watch("cfg/created")
+
+	time.Sleep(100 * time.Millisecond)
+	if state := watcher.State(); state != ETCDWatch_Retrying {
+		t.Fatalf("State before Created = %s, want retrying", state)
+	}
+
+	close(watch.created)
+	waitFor(t, func() bool { return watcher.State() == ETCDWatch_Connected })
+}
+
+func TestETCDDiscovery_Sync(t *testing.T) {
+
+	client, fake := newFakeClient(t)
+	ctx := context.Background()
+
+	conns := &GRPC.GRPCClient{DialOptions: []grpc.DialOption{grpc.WithInsecure()}}
+	if conns.Connect("billing", "billing.local:9000") == nil {
+		t.Fatal("Connect billing failed")
+	}
+
+	discovery, err := client.Discover("/services", conns)
+	if err != nil {
+		t.Fatalf("Discover: %v", err)
+	}
+
+	changes := make(chan map[string]string, 8)
+	discovery.OnChange = func(services map[string]string) {
+		changes <- services
+	}
+
+	waitFor(t, func() bool { return discovery.watcher.State() == ETCDWatch_Connected })
+
+	instance := func(service, id, addr string, at int64) etcd.Op {
+		return etcd.OpPut("/services/"+service+"/"+id,
+			fmt.Sprintf(`{"service":%q,"id":%q,"address":%q,"registeredAt":%d}`, service, id, addr, at))
+	}
+
+	// three instances at one revision arrive in one watch response
+	_, err = fake.Txn(ctx).Then(
+		instance("api", "1", "api-1:9000", 1),
+		instance("api", "2", "api-2:9000", 2),
+		instance("web", "1", "web-1:9000", 1),
+	).Commit()
+	if err != nil {
+		t.Fatalf("Txn: %v", err)
+	}
+
+	select {
+	case services := <-changes:
+		want := map[string]string{"api": "api-1:9000", "web": "web-1:9000"}
+		if !reflect.DeepEqual(services, want) {
+			t.Fatalf("services = %v, want %v", services, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no sync after the instances were registered")
+	}
+
+	select {
+	case services := <-changes:
+		t.Fatalf("synced again for the same response: %v", services)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if _, err := fake.Delete(ctx, "/services/web/1"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+
+	select {
+	case <-changes:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no sync after web left")
+	}
+
+	if conn := conns.GetConnection("web"); conn != nil {
+		t.Fatalf("web still connected to %s", conn.Address)
+	}
+	if conn := conns.GetConnection("api"); conn == nil || conn.Address != "api-1:9000" {
+		t.Fatalf("api connection = %+v, want api-1:9000", conn)
+	}
+
+	// opened by the application, not by discovery
+	if conns.GetConnection("billing") == nil {
+		t.Fatal("discovery closed the billing connection")
+	}
+
+	discovery.Stop()
+	if watchers := client.Watchers(); len(watchers) != 0 {
+		t.Fatalf("%d watchers left after Stop", len(watchers))
+	}
+}
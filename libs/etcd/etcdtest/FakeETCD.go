@@ -0,0 +1,455 @@
+package ETCDTest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sort"
+	"sync"
+
+	etcd "github.com/coreos/etcd/clientv3"
+	pb "github.com/coreos/etcd/etcdserver/etcdserverpb"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+)
+
+var (
+	_ etcd.KV      = (*FakeETCD)(nil)
+	_ etcd.Watcher = (*FakeETCD)(nil)
+)
+
+var ErrETCD_FakeUnsupported = errors.New("etcd operation not supported by FakeETCD")
+
+// FakeETCD in-memory etcd.KV and etcd.Watcher for tests, plug it with ETCDClient.InitWith.
+// Get/Put/Delete honor WithPrefix, WithRange and WithFromKey, Get also the revision filters, WithKeysOnly
+// and WithCountOnly. Txn compares and applies its gets, puts and deletes atomically at one revision.
+// Watch honors WithPrefix, replays history from WithRev and always starts with a Created response as if
+// WithCreatedNotify was given. Reads are always at the current revision; leases, nested txns, Do and
+// Compact are not supported
+type FakeETCD struct {
+	revision int64
+	data     map[string]*mvccpb.KeyValue
+	history  []*etcd.Event
+	watches  map[*fakeWatch]struct{}
+	lock     sync.Mutex
+}
+
+type fakeWatch struct {
+	key, end []byte
+	pending  []*etcd.Event
+	signal   chan struct{}
+}
+
+// NewFakeETCD ...
+func NewFakeETCD() *FakeETCD {
+	return &FakeETCD{
+		data:    make(map[string]*mvccpb.KeyValue),
+		watches: make(map[*fakeWatch]struct{}),
+	}
+}
+
+// Revision current store revision
+func (this *FakeETCD) Revision() int64 {
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	return this.revision
+}
+
+func (this *FakeETCD) Get(ctx context.Context, key string, opts ...etcd.OpOption) (*etcd.GetResponse, error) {
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	op := etcd.OpGet(key, opts...)
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	return (*etcd.GetResponse)(this.rangeKeys(op)), nil
+}
+
+func (this *FakeETCD) Put(ctx context.Context, key, val string, opts ...etcd.OpOption) (*etcd.PutResponse, error) {
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.revision++
+	this.put(key, val)
+
+	return &etcd.PutResponse{Header: this.header()}, nil
+}
+
+func (this *FakeETCD) Delete(ctx context.Context, key string, opts ...etcd.OpOption) (*etcd.DeleteResponse, error) {
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	op := etcd.OpDelete(key, opts...)
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	keys := this.match(op.KeyBytes(), op.RangeBytes())
+	if len(keys) == 0 {
+		return &etcd.DeleteResponse{Header: this.header()}, nil
+	}
+
+	this.revision++
+	this.delete(keys)
+
+	return &etcd.DeleteResponse{Header: this.header(), Deleted: int64(len(keys))}, nil
+}
+
+func (this *FakeETCD) Compact(ctx context.Context, rev int64, opts ...etcd.CompactOption) (*etcd.CompactResponse, error) {
+	return nil, ErrETCD_FakeUnsupported
+}
+
+func (this *FakeETCD) Do(ctx context.Context, op etcd.Op) (etcd.OpResponse, error) {
+	return etcd.OpResponse{}, ErrETCD_FakeUnsupported
+}
+
+func (this *FakeETCD) Txn(ctx context.Context) etcd.Txn {
+	return &fakeTxn{fake: this, ctx: ctx}
+}
+
+// Watch stream changes of key until ctx is done, replaying the history from WithRev first
+func (this *FakeETCD) Watch(ctx context.Context, key string, opts ...etcd.OpOption) etcd.WatchChan {
+
+	op := etcd.OpGet(key, opts...)
+	watch := &fakeWatch{key: op.KeyBytes(), end: op.RangeBytes(), signal: make(chan struct{}, 1)}
+
+	this.lock.Lock()
+	if op.Rev() > 0 {
+		for _, event := range this.history {
+			if event.Kv.ModRevision >= op.Rev() && fakeMatch(watch.key, watch.end, event.Kv.Key) {
+				watch.pending = append(watch.pending, event)
+			}
+		}
+	}
+	if len(watch.pending) > 0 {
+		watch.signal <- struct{}{}
+	}
+	this.watches[watch] = struct{}{}
+	created := etcd.WatchResponse{Header: *this.header(), Created: true}
+	this.lock.Unlock()
+
+	watchan := make(chan etcd.WatchResponse)
+	go this.forward(ctx, watch, created, watchan)
+
+	return watchan
+}
+
+func (this *FakeETCD) RequestProgress(ctx context.Context) error {
+	return nil
+}
+
+func (this *FakeETCD) Close() error {
+	return nil
+}
+
+// forward push created then pending events of watch to watchan, one response per revision, until ctx
+// is done
+func (this *FakeETCD) forward(ctx context.Context, watch *fakeWatch, created etcd.WatchResponse, watchan chan etcd.WatchResponse) {
+
+	defer close(watchan)
+	defer func() {
+		this.lock.Lock()
+		delete(this.watches, watch)
+		this.lock.Unlock()
+	}()
+
+	select {
+	case watchan <- created:
+	case <-ctx.Done():
+		return
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-watch.signal:
+		}
+
+		this.lock.Lock()
+		pending := watch.pending
+		watch.pending = nil
+		this.lock.Unlock()
+
+		for len(pending) > 0 {
+			n := 1
+			for n < len(pending) && pending[n].Kv.ModRevision == pending[0].Kv.ModRevision {
+				n++
+			}
+
+			resp := etcd.WatchResponse{Header: pb.ResponseHeader{Revision: pending[n-1].Kv.ModRevision}, Events: pending[:n]}
+			select {
+			case watchan <- resp:
+			case <-ctx.Done():
+				return
+			}
+
+			pending = pending[n:]
+		}
+	}
+}
+
+// rangeKeys keys of op at the current revision, lock must be held
+func (this *FakeETCD) rangeKeys(op etcd.Op) *pb.RangeResponse {
+
+	resp := &pb.RangeResponse{Header: this.header()}
+	for _, k := range this.match(op.KeyBytes(), op.RangeBytes()) {
+
+		kv := this.data[k]
+		switch {
+		case op.MinCreateRev() > 0 && kv.CreateRevision < op.MinCreateRev(),
+			op.MaxCreateRev() > 0 && kv.CreateRevision > op.MaxCreateRev(),
+			op.MinModRev() > 0 && kv.ModRevision < op.MinModRev(),
+			op.MaxModRev() > 0 && kv.ModRevision > op.MaxModRev():
+			continue
+		}
+
+		resp.Count++
+		if op.IsCountOnly() {
+			continue
+		}
+
+		copied := *kv
+		if op.IsKeysOnly() {
+			copied.Value = nil
+		}
+		resp.Kvs = append(resp.Kvs, &copied)
+	}
+
+	return resp
+}
+
+// put store key at the current revision, lock must be held
+func (this *FakeETCD) put(key, val string) {
+
+	kv := &mvccpb.KeyValue{Key: []byte(key), Value: []byte(val), CreateRevision: this.revision, ModRevision: this.revision, Version: 1}
+	if old, ok := this.data[key]; ok {
+		kv.CreateRevision = old.CreateRevision
+		kv.Version = old.Version + 1
+	}
+
+	this.data[key] = kv
+	this.publish(&etcd.Event{Type: mvccpb.PUT, Kv: kv})
+}
+
+// delete remove keys at the current revision, lock must be held
+func (this *FakeETCD) delete(keys []string) {
+
+	for _, k := range keys {
+		delete(this.data, k)
+		this.publish(&etcd.Event{Type: mvccpb.DELETE, Kv: &mvccpb.KeyValue{Key: []byte(k), ModRevision: this.revision}})
+	}
+}
+
+// match sorted keys in [start, end), lock must be held
+func (this *FakeETCD) match(start, end []byte) []string {
+
+	keys := make([]string, 0)
+	for k, kv := range this.data {
+		if fakeMatch(start, end, kv.Key) {
+			keys = append(keys, k)
+		}
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+// publish record event and queue it on every matching watch, lock must be held
+func (this *FakeETCD) publish(event *etcd.Event) {
+
+	this.history = append(this.history, event)
+
+	for watch := range this.watches {
+		if !fakeMatch(watch.key, watch.end, event.Kv.Key) {
+			continue
+		}
+
+		watch.pending = append(watch.pending, event)
+		select {
+		case watch.signal <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (this *FakeETCD) header() *pb.ResponseHeader {
+	return &pb.ResponseHeader{Revision: this.revision}
+}
+
+// fakeMatch key falls in [start, end), end nil means start only and "\x00" means every key from start
+func fakeMatch(start, end, key []byte) bool {
+
+	switch {
+	case len(end) == 0:
+		return string(key) == string(start)
+	case len(end) == 1 && end[0] == 0:
+		return string(key) >= string(start)
+	}
+
+	return string(key) >= string(start) && string(key) < string(end)
+}
+
+type fakeTxn struct {
+	fake    *FakeETCD
+	ctx     context.Context
+	cmps    []etcd.Cmp
+	thenOps []etcd.Op
+	elseOps []etcd.Op
+}
+
+func (this *fakeTxn) If(cs ...etcd.Cmp) etcd.Txn {
+	this.cmps = cs
+	return this
+}
+
+func (this *fakeTxn) Then(ops ...etcd.Op) etcd.Txn {
+	this.thenOps = ops
+	return this
+}
+
+func (this *fakeTxn) Else(ops ...etcd.Op) etcd.Txn {
+	this.elseOps = ops
+	return this
+}
+
+// Commit evaluate the compares and apply the matching ops, all writes share one new revision as in etcd
+func (this *fakeTxn) Commit() (*etcd.TxnResponse, error) {
+
+	if err := this.ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	this.fake.lock.Lock()
+	defer this.fake.lock.Unlock()
+
+	succeeded := true
+	for i := range this.cmps {
+		if !this.fake.compare(&this.cmps[i]) {
+			succeeded = false
+			break
+		}
+	}
+
+	ops := this.thenOps
+	if !succeeded {
+		ops = this.elseOps
+	}
+
+	for _, op := range ops {
+		if op.IsTxn() {
+			return nil, ErrETCD_FakeUnsupported
+		}
+	}
+
+	resp := &etcd.TxnResponse{Succeeded: succeeded}
+	written := false
+	for _, op := range ops {
+
+		switch {
+		case op.IsGet():
+			resp.Responses = append(resp.Responses, &pb.ResponseOp{
+				Response: &pb.ResponseOp_ResponseRange{ResponseRange: this.fake.rangeKeys(op)},
+			})
+		case op.IsPut():
+			if !written {
+				this.fake.revision++
+				written = true
+			}
+			this.fake.put(string(op.KeyBytes()), string(op.ValueBytes()))
+			resp.Responses = append(resp.Responses, &pb.ResponseOp{
+				Response: &pb.ResponseOp_ResponsePut{ResponsePut: &pb.PutResponse{Header: this.fake.header()}},
+			})
+		case op.IsDelete():
+			keys := this.fake.match(op.KeyBytes(), op.RangeBytes())
+			if len(keys) > 0 && !written {
+				this.fake.revision++
+				written = true
+			}
+			this.fake.delete(keys)
+			resp.Responses = append(resp.Responses, &pb.ResponseOp{
+				Response: &pb.ResponseOp_ResponseDeleteRange{ResponseDeleteRange: &pb.DeleteRangeResponse{Header: this.fake.header(), Deleted: int64(len(keys))}},
+			})
+		}
+	}
+
+	resp.Header = this.fake.header()
+	return resp, nil
+}
+
+// compare whether every key in range of cmp satisfies it. A missing key compares as zero, except on
+// value where it always fails, lock must be held
+func (this *FakeETCD) compare(cmp *etcd.Cmp) bool {
+
+	keys := this.match(cmp.KeyBytes(), cmp.RangeEnd)
+	if len(keys) == 0 {
+		if cmp.Target == pb.Compare_VALUE {
+			return false
+		}
+		return compareKV(cmp, &mvccpb.KeyValue{})
+	}
+
+	for _, k := range keys {
+		if !compareKV(cmp, this.data[k]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func compareKV(cmp *etcd.Cmp, kv *mvccpb.KeyValue) bool {
+
+	var result int
+	switch union := cmp.TargetUnion.(type) {
+	case *pb.Compare_Value:
+		result = bytes.Compare(kv.Value, union.Value)
+	case *pb.Compare_Version:
+		result = compareInt64(kv.Version, union.Version)
+	case *pb.Compare_CreateRevision:
+		result = compareInt64(kv.CreateRevision, union.CreateRevision)
+	case *pb.Compare_ModRevision:
+		result = compareInt64(kv.ModRevision, union.ModRevision)
+	case *pb.Compare_Lease:
+		result = compareInt64(kv.Lease, union.Lease)
+	default:
+		return false
+	}
+
+	switch cmp.Result {
+	case pb.Compare_EQUAL:
+		return result == 0
+	case pb.Compare_NOT_EQUAL:
+		return result != 0
+	case pb.Compare_GREATER:
+		return result > 0
+	case pb.Compare_LESS:
+		return result < 0
+	}
+
+	return false
+}
+
+func compareInt64(a, b int64) int {
+
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+
+	return 0
+}
@@ -46,6 +46,8 @@ type GRPCClient struct {
 	DialOptions []grpc.DialOption
 	Connections map[string]*GRPCConnection
 	Lock        sync.RWMutex
+
+	discovered map[string]bool // connections opened by ConnectAll
 }
 
 func (this *GRPCClient) Reset(config *GRPCClientConfig) error {
@@ -164,37 +166,55 @@ func (this *GRPCClient) Connect(name string, addr string) *GRPCConnection {
 	return grpcConnection
 }
 
+// ConnectAll make the connections it opened match services, closing those whose service is gone or
+// moved once their calls finish. Connections opened with Connect are left alone
 func (this *GRPCClient) ConnectAll(services map[string]string) {
 
-	olds, news := make(map[string]bool), make(map[string]bool)
-	for _, v := range this.Connections {
-		olds[v.Name] = true
-	}
-	for name, _ := range services {
-		news[name] = true
-	}
-	if news == nil {
-		news = make(map[string]bool)
-	}
-
-	// close none-existed clients
-	if olds != nil && len(olds) > 0 {
+	stale := []*GRPCConnection{}
 
-		for _, v := range this.Connections {
-
-			_, okOld := olds[v.Name]
-			_, okNew := news[v.Name]
+	this.Lock.Lock()
+	for name := range this.discovered {
+		conn, ok := this.Connections[name]
+		if !ok {
+			delete(this.discovered, name)
+			continue
+		}
 
-			if okOld && !okNew {
-				v.Close()
-			}
+		if addr, ok := services[name]; !ok || addr != conn.Address {
+			stale = append(stale, conn)
+			delete(this.Connections, name)
+			delete(this.discovered, name)
 		}
+	}
+	this.Lock.Unlock()
 
+	// Close waits for in-flight calls, keep the client usable meanwhile
+	for _, conn := range stale {
+		conn.Close()
 	}
 
 	// connect new clients
 	for name, addr := range services {
-		this.Connect(name, addr)
+
+		this.Lock.RLock()
+		_, exists := this.Connections[name]
+		owned := this.discovered[name]
+		this.Lock.RUnlock()
+
+		if exists && !owned {
+			continue
+		}
+
+		if this.Connect(name, addr) == nil {
+			continue
+		}
+
+		this.Lock.Lock()
+		if this.discovered == nil {
+			this.discovered = make(map[string]bool)
+		}
+		this.discovered[name] = true
+		this.Lock.Unlock()
 	}
 
 }
@@ -210,6 +230,7 @@ func (this *GRPCClient) CloseAll() {
 	}
 
 	this.Connections = make(map[string]*GRPCConnection)
+	this.discovered = nil
 }
 
 func (this *BaseRequest) LoadParams(params interface{}) {
@@ -236,3 +257,21 @@ func (this *GRPCClient) Call(srvName string, req BaseRequest, result interface{}
 	Bytes.Decode(res.Result, &result)
 	return nil
 }
+
+// Execute send req to srvName within ctx and return the raw response, BaseResponse.Error is left to
+// the caller. ErrServiceNotAvailable when srvName is not connected
+func (this *GRPCClient) Execute(ctx context.Context, srvName string, req BaseRequest) (*BaseResponse, error) {
+
+	conn := this.GetConnection(srvName)
+	if conn == nil {
+		return nil, Const.ErrServiceNotAvailable
+	}
+
+	conn.Lock.RLock()
+	defer conn.Lock.RUnlock()
+
+	req.ReqAt = time.Now().UnixNano()
+
+	session := NewGRPCServiceClient(conn.Connection)
+	return session.Execute(ctx, &req)
+}
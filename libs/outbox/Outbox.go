@@ -0,0 +1,345 @@
+package Outbox
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	DB "iparking/share/libs/db"
+	Logger "iparking/share/libs/logger"
+	Bytes "iparking/share/utils/bytes"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	defaultTable        = "outbox"
+	defaultBatchSize    = 100
+	defaultPollInterval = time.Second
+	defaultRetryBackoff = time.Second
+	defaultClaimTimeout = 5 * time.Minute
+	maxRetryBackoff     = time.Hour
+	maxErrorLength      = 1024
+)
+
+var (
+	// ErrOutbox_InvalidTable ...
+	ErrOutbox_InvalidTable = errors.New("Outbox: invalid table name")
+	// ErrOutbox_NoPublisher ...
+	ErrOutbox_NoPublisher = errors.New("Outbox: no publisher")
+
+	tableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// Event row of the outbox table, Payload is msgpack encoded (utils/bytes)
+type Event struct {
+	ID        int64
+	Topic     string
+	Payload   []byte
+	Attempts  int
+	CreatedAt time.Time
+}
+
+// Publisher deliver an event downstream. It may be called more than once for the same event
+// (at-least-once), consumers should dedupe on Event.ID
+type Publisher interface {
+	Publish(ctx context.Context, event Event) error
+}
+
+// Outbox transactional outbox table on DB
+type Outbox struct {
+	DB *DB.DBInstance
+
+	// default outbox
+	Table string
+}
+
+func (this *Outbox) table() (string, error) {
+
+	table := this.Table
+	if len(table) == 0 {
+		table = defaultTable
+	}
+
+	if !tableName.MatchString(table) {
+		return "", ErrOutbox_InvalidTable
+	}
+
+	return table, nil
+}
+
+// EnsureTable create the outbox table if it does not exist
+func (this *Outbox) EnsureTable(ctx context.Context) error {
+
+	table, err := this.table()
+	if err != nil {
+		return err
+	}
+
+	if this.DB.Type() == DB.DBType_Postgres {
+		if _, err := this.DB.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS "+table+" ("+
+			"id BIGSERIAL PRIMARY KEY, "+
+			"topic VARCHAR(255) NOT NULL, "+
+			"payload BYTEA NOT NULL, "+
+			"attempts INT NOT NULL DEFAULT 0, "+
+			"next_attempt_at TIMESTAMPTZ NOT NULL, "+
+			"created_at TIMESTAMPTZ NOT NULL, "+
+			"delivered_at TIMESTAMPTZ NULL, "+
+			"last_error TEXT NULL)"); err != nil {
+			return err
+		}
+		_, err := this.DB.ExecContext(ctx, "CREATE INDEX IF NOT EXISTS "+table+"_pending ON "+table+" (delivered_at, next_attempt_at)")
+		return err
+	}
+
+	_, err = this.DB.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS "+table+" ("+
+		"id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY, "+
+		"topic VARCHAR(255) NOT NULL, "+
+		"payload MEDIUMBLOB NOT NULL, "+
+		"attempts INT NOT NULL DEFAULT 0, "+
+		"next_attempt_at DATETIME(6) NOT NULL, "+
+		"created_at DATETIME(6) NOT NULL, "+
+		"delivered_at DATETIME(6) NULL, "+
+		"last_error TEXT NULL, "+
+		"KEY "+table+"_pending (delivered_at, next_attempt_at))")
+	return err
+}
+
+// Enqueue add an event to the outbox inside tx, it becomes visible to the relay only if tx commits.
+// payload is msgpack encoded
+func (this *Outbox) Enqueue(ctx context.Context, tx *sql.Tx, topic string, payload interface{}) error {
+
+	encoded, err := Bytes.Encode(payload)
+	if err != nil {
+		return err
+	}
+
+	return this.EnqueueRaw(ctx, tx, topic, encoded)
+}
+
+// EnqueueRaw add an already encoded event to the outbox inside tx
+func (this *Outbox) EnqueueRaw(ctx context.Context, tx *sql.Tx, topic string, payload []byte) error {
+
+	table, err := this.table()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	_, err = tx.ExecContext(ctx, this.DB.Builder().Rebind(
+		"INSERT INTO "+table+" (topic, payload, attempts, next_attempt_at, created_at) VALUES (?, ?, 0, ?, ?)"),
+		topic, payload, now, now)
+	return err
+}
+
+// Relay poll the outbox and deliver pending events through Publisher.
+// Several relays may run on the same table: a short transaction claims due rows with SELECT ... FOR UPDATE
+// SKIP LOCKED (mysql 8+, postgres 9.5+) and pushes their next_attempt_at ClaimTimeout ahead. Events are
+// then published outside of any transaction and each row is marked on its own, so a relay that dies
+// mid-batch only delays its unmarked events by ClaimTimeout
+type Relay struct {
+	Outbox    *Outbox
+	Publisher Publisher
+
+	// rows per poll, default 100
+	BatchSize int
+	// pause between polls when the outbox is drained, default 1s
+	PollInterval time.Duration
+	// first retry delay, doubled on each failure up to 1h, default 1s
+	RetryBackoff time.Duration
+	// give up on an event after MaxAttempts failures, 0 retries forever
+	MaxAttempts int
+	// how long claimed events are hidden from other relays, must exceed the time to publish a batch,
+	// default 5m
+	ClaimTimeout time.Duration
+}
+
+// Run poll until ctx is done
+func (this *Relay) Run(ctx context.Context) error {
+
+	interval := this.PollInterval
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+
+	for {
+		n, err := this.Poll(ctx)
+		if err != nil {
+			Logger.WriteLog("Outbox relay poll failed with error : " + err.Error())
+		}
+
+		// keep going while full batches come back
+		if err == nil && n >= this.batchSize() {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+func (this *Relay) batchSize() int {
+
+	if this.BatchSize <= 0 {
+		return defaultBatchSize
+	}
+
+	return this.BatchSize
+}
+
+// Poll claim and deliver one batch of due events, return how many were claimed
+func (this *Relay) Poll(ctx context.Context) (int, error) {
+
+	if this.Publisher == nil {
+		return 0, ErrOutbox_NoPublisher
+	}
+
+	table, err := this.Outbox.table()
+	if err != nil {
+		return 0, err
+	}
+
+	events, err := this.claim(ctx, table)
+	if err != nil {
+		return 0, err
+	}
+
+	builder := this.Outbox.DB.Builder()
+
+	var markErr error
+	for _, event := range events {
+
+		query := "UPDATE " + table + " SET attempts = attempts + 1, delivered_at = ?, last_error = NULL WHERE id = ?"
+		args := []interface{}{time.Now().UTC(), event.ID}
+
+		if err := this.Publisher.Publish(ctx, event); err != nil {
+			msg := err.Error()
+			if len(msg) > maxErrorLength {
+				msg = msg[:maxErrorLength]
+			}
+			query = "UPDATE " + table + " SET attempts = attempts + 1, next_attempt_at = ?, last_error = ? WHERE id = ?"
+			args = []interface{}{time.Now().UTC().Add(this.backoff(event.Attempts)), msg, event.ID}
+		}
+
+		// an unmarked event is published again once its claim expires
+		if _, err := this.Outbox.DB.ExecContext(ctx, builder.Rebind(query), args...); err != nil && markErr == nil {
+			markErr = err
+		}
+	}
+
+	return len(events), markErr
+}
+
+// claim lock one batch of due events and hide them from other relays for ClaimTimeout
+func (this *Relay) claim(ctx context.Context, table string) ([]Event, error) {
+
+	db := this.Outbox.DB
+	builder := db.Builder()
+
+	var events []Event
+	err := db.WithTx(ctx, nil, func(tx *sql.Tx) error {
+
+		events = nil
+
+		now := time.Now().UTC()
+		query := "SELECT id, topic, payload, attempts FROM " + table +
+			" WHERE delivered_at IS NULL AND next_attempt_at <= ?"
+		args := []interface{}{now}
+		if this.MaxAttempts > 0 {
+			query += " AND attempts < ?"
+			args = append(args, this.MaxAttempts)
+		}
+		query += fmt.Sprintf(" ORDER BY id LIMIT %d FOR UPDATE SKIP LOCKED", this.batchSize())
+
+		rows, err := tx.QueryContext(ctx, builder.Rebind(query), args...)
+		if err != nil {
+			return err
+		}
+
+		for rows.Next() {
+			var event Event
+			if err := rows.Scan(&event.ID, &event.Topic, &event.Payload, &event.Attempts); err != nil {
+				rows.Close()
+				return err
+			}
+			events = append(events, event)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		if len(events) == 0 {
+			return nil
+		}
+
+		ids := make([]interface{}, 0, len(events)+1)
+		ids = append(ids, now.Add(this.claimTimeout()))
+		for _, event := range events {
+			ids = append(ids, event.ID)
+		}
+
+		_, err = tx.ExecContext(ctx, builder.Rebind(
+			"UPDATE "+table+" SET next_attempt_at = ? WHERE id IN ("+strings.TrimSuffix(strings.Repeat("?, ", len(events)), ", ")+")"),
+			ids...)
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
+
+func (this *Relay) claimTimeout() time.Duration {
+
+	if this.ClaimTimeout <= 0 {
+		return defaultClaimTimeout
+	}
+
+	return this.ClaimTimeout
+}
+
+// backoff delay before the next attempt of an event which failed attempts times before
+func (this *Relay) backoff(attempts int) time.Duration {
+
+	d := this.RetryBackoff
+	if d <= 0 {
+		d = defaultRetryBackoff
+	}
+
+	for i := 0; i < attempts && d < maxRetryBackoff; i++ {
+		d *= 2
+	}
+
+	if d > maxRetryBackoff {
+		d = maxRetryBackoff
+	}
+
+	return d
+}
+
+// Purge delete events delivered before olderThan, return how many were removed
+func (this *Outbox) Purge(ctx context.Context, olderThan time.Time) (int64, error) {
+
+	table, err := this.table()
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := this.DB.ExecContext(ctx, this.DB.Builder().Rebind(
+		"DELETE FROM "+table+" WHERE delivered_at IS NOT NULL AND delivered_at < ?"), olderThan.UTC())
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
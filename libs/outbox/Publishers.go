@@ -0,0 +1,89 @@
+package Outbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	GRPC "iparking/share/libs/grpc"
+	Redis "iparking/share/libs/redis"
+	"strconv"
+
+	"github.com/go-redis/redis"
+)
+
+var (
+	// ErrOutbox_NoConnection ...
+	ErrOutbox_NoConnection = errors.New("Outbox: no grpc connection")
+	// ErrOutbox_NoRedis ...
+	ErrOutbox_NoRedis = errors.New("Outbox: redis client is not connected")
+	// ErrOutbox_Rejected ...
+	ErrOutbox_Rejected = errors.New("Outbox: event rejected by the service")
+)
+
+// RedisStreamPublisher XADD each event to a Redis stream as fields id, topic, payload
+type RedisStreamPublisher struct {
+	Client *Redis.RedisClient
+
+	// stream name, the event topic when empty
+	Stream string
+
+	// approximate stream cap, 0 means unbounded
+	MaxLen int64
+}
+
+func (this *RedisStreamPublisher) Publish(ctx context.Context, event Event) error {
+
+	stream := this.Stream
+	if len(stream) == 0 {
+		stream = event.Topic
+	}
+
+	cmd := this.Client.XAdd(&redis.XAddArgs{
+		Stream:       stream,
+		MaxLenApprox: this.MaxLen,
+		Values: map[string]interface{}{
+			"id":      strconv.FormatInt(event.ID, 10),
+			"topic":   event.Topic,
+			"payload": event.Payload,
+		},
+	})
+	if cmd == nil {
+		return ErrOutbox_NoRedis
+	}
+
+	return cmd.Err()
+}
+
+// GRPCPublisher call Service.<event topic> through Connection of a GRPCClient with the payload as params.
+// An error returned by the service leaves the event pending
+type GRPCPublisher struct {
+	Client *GRPC.GRPCClient
+
+	// connection name given to GRPCClient.Connect / ConnectAll
+	Connection string
+
+	// service name registered on the server
+	Service string
+}
+
+func (this *GRPCPublisher) Publish(ctx context.Context, event Event) error {
+
+	if this.Client.GetConnection(this.Connection) == nil {
+		return ErrOutbox_NoConnection
+	}
+
+	res, err := this.Client.Execute(ctx, this.Connection, GRPC.BaseRequest{
+		Service: this.Service,
+		Method:  event.Topic,
+		Params:  event.Payload,
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(res.Error) > 0 {
+		return fmt.Errorf("%w: %s", ErrOutbox_Rejected, res.Error)
+	}
+
+	return nil
+}
@@ -9,10 +9,17 @@ import (
 	"github.com/go-redis/redis"
 )
 
+const defaultRedisDrainTimeout = 30 * time.Second
+
 type RedisClient struct {
 	Client        *redis.Client
 	ClusterClient *redis.ClusterClient
 	Lock          sync.RWMutex
+
+	// seconds a replaced client keeps serving the commands it already started, default 30
+	DrainTimeoutInSecond int
+
+	inflight *sync.WaitGroup // commands running on the current client
 }
 
 func init() {
@@ -38,129 +45,190 @@ func (this *RedisClient) Connect(config *RedisConfig) error {
 
 func (this *RedisClient) NewStandaloneClient(opts *redis.Options) {
 
-	this.Lock.Lock()
-	defer this.Lock.Unlock()
-
 	if opts == nil {
 		opts = &redis.Options{}
 	}
 
-	if this.Client != nil {
-		this.Client.Close()
-	}
-
-	this.Client = redis.NewClient(opts)
+	this.swap(redis.NewClient(opts), nil)
 }
 
 func (this *RedisClient) NewSentinelClient(opt *redis.FailoverOptions) {
 
-	this.Lock.Lock()
-	defer this.Lock.Unlock()
-
 	if opt == nil {
 		opt = &redis.FailoverOptions{}
 	}
 
-	if this.Client != nil {
-		this.Client.Close()
+	this.swap(redis.NewFailoverClient(opt), nil)
+}
+
+func (this *RedisClient) NewClusterClient(opt *redis.ClusterOptions) {
+
+	if opt == nil {
+		opt = &redis.ClusterOptions{}
 	}
 
-	this.Client = redis.NewFailoverClient(opt)
+	this.swap(nil, redis.NewClusterClient(opt))
 }
 
-func (this *RedisClient) NewClusterClient(opt *redis.ClusterOptions) {
+// swap make client or cluster the only client, so a reconnect in another mode never keeps serving
+// commands from the old one. The previous client stops taking commands immediately and is closed once
+// its in-flight commands finish (or DrainTimeoutInSecond passes)
+func (this *RedisClient) swap(client *redis.Client, cluster *redis.ClusterClient) {
 
 	this.Lock.Lock()
-	defer this.Lock.Unlock()
+	oldClient, oldCluster, inflight := this.Client, this.ClusterClient, this.inflight
+	this.Client, this.ClusterClient = client, cluster
+	this.inflight = &sync.WaitGroup{}
+	this.Lock.Unlock()
 
-	if opt == nil {
-		opt = &redis.ClusterOptions{}
+	if oldClient != nil || oldCluster != nil {
+		go this.drain(oldClient, oldCluster, inflight)
 	}
+}
 
-	if this.ClusterClient != nil {
-		this.ClusterClient.Close()
+func (this *RedisClient) drain(client *redis.Client, cluster *redis.ClusterClient, inflight *sync.WaitGroup) {
+
+	if inflight != nil {
+		done := make(chan struct{})
+		go func() {
+			inflight.Wait()
+			close(done)
+		}()
+
+		timeout := defaultRedisDrainTimeout
+		if this.DrainTimeoutInSecond > 0 {
+			timeout = time.Duration(this.DrainTimeoutInSecond) * time.Second
+		}
+
+		select {
+		case <-done:
+		case <-time.After(timeout):
+		}
 	}
 
-	this.ClusterClient = redis.NewClusterClient(opt)
+	if client != nil {
+		client.Close()
+	}
+
+	if cluster != nil {
+		cluster.Close()
+	}
 }
 
-func (this *RedisClient) Get(key string) *redis.StringCmd {
+// acquire client of the connected mode, nil when not connected. The caller must call release once its
+// command is done, a reconnect waits for it before closing the client
+func (this *RedisClient) acquire() (client redis.Cmdable, release func()) {
 
 	this.Lock.RLock()
 	defer this.Lock.RUnlock()
 
-	if this.Client != nil {
-		return this.Client.Get(key)
+	switch {
+	case this.Client != nil:
+		client = this.Client
+	case this.ClusterClient != nil:
+		client = this.ClusterClient
+	default:
+		return nil, func() {}
 	}
 
-	if this.ClusterClient != nil {
-		return this.ClusterClient.Get(key)
+	// clients assigned to the fields directly are not tracked
+	if this.inflight == nil {
+		return client, func() {}
 	}
 
-	return nil
+	this.inflight.Add(1)
+	return client, this.inflight.Done
 }
 
-func (this *RedisClient) Set(key string, val interface{}, exp time.Duration) *redis.StatusCmd {
+// Cmdable client of the connected mode, standalone, sentinel or cluster, exposing every redis command.
+// nil when not connected. Its commands are not tracked, a reconnect may close it under them: prefer Run
+func (this *RedisClient) Cmdable() redis.Cmdable {
 
 	this.Lock.RLock()
 	defer this.Lock.RUnlock()
 
 	if this.Client != nil {
-		return this.Client.Set(key, val, exp)
+		return this.Client
 	}
 
 	if this.ClusterClient != nil {
-		return this.ClusterClient.Set(key, val, exp)
+		return this.ClusterClient
 	}
 
 	return nil
 }
 
-func (this *RedisClient) Del(keys ...string) *redis.IntCmd {
+// Run call fn with the client of the connected mode, which a reconnect keeps open until fn returns.
+// ErrRedis_NotConnected when not connected
+func (this *RedisClient) Run(fn func(client redis.Cmdable) error) error {
 
-	this.Lock.RLock()
-	defer this.Lock.RUnlock()
+	client, release := this.acquire()
+	defer release()
 
-	if this.Client != nil {
-		return this.Client.Del(keys...)
+	if client == nil {
+		return Const.ErrRedis_NotConnected
 	}
 
-	if this.ClusterClient != nil {
-		return this.ClusterClient.Del(keys...)
+	return fn(client)
+}
+
+func (this *RedisClient) Get(key string) *redis.StringCmd {
+
+	client, release := this.acquire()
+	defer release()
+
+	if client != nil {
+		return client.Get(key)
 	}
 
 	return nil
 }
 
-// ZAdd add members to zsorted list (list defers each other from key)
-func (this *RedisClient) ZAdd(key string, Members ...redis.Z) *redis.IntCmd {
+func (this *RedisClient) Set(key string, val interface{}, exp time.Duration) *redis.StatusCmd {
 
-	this.Lock.RLock()
-	defer this.Lock.RUnlock()
+	client, release := this.acquire()
+	defer release()
 
-	if this.Client != nil {
-		return this.Client.ZAdd(key, Members...)
+	if client != nil {
+		return client.Set(key, val, exp)
 	}
 
-	if this.ClusterClient != nil {
-		return this.ClusterClient.ZAdd(key, Members...)
+	return nil
+}
+
+func (this *RedisClient) Del(keys ...string) *redis.IntCmd {
+
+	client, release := this.acquire()
+	defer release()
+
+	if client != nil {
+		return client.Del(keys...)
 	}
 
 	return nil
 }
 
-// ZRem remove members from zsorted list (list defers each other from key)
-func (this *RedisClient) ZRem(key string, Members ...interface{}) *redis.IntCmd {
+// ZAdd add members to zsorted list (list defers each other from key)
+func (this *RedisClient) ZAdd(key string, Members ...redis.Z) *redis.IntCmd {
 
-	this.Lock.RLock()
-	defer this.Lock.RUnlock()
+	client, release := this.acquire()
+	defer release()
 
-	if this.Client != nil {
-		return this.Client.ZRem(key, Members...)
+	if client != nil {
+		return client.ZAdd(key, Members...)
 	}
 
-	if this.ClusterClient != nil {
-		return this.ClusterClient.ZRem(key, Members...)
+	return nil
+}
+
+// ZRem remove members from zsorted list (list defers each other from key)
+func (this *RedisClient) ZRem(key string, Members ...interface{}) *redis.IntCmd {
+
+	client, release := this.acquire()
+	defer release()
+
+	if client != nil {
+		return client.ZRem(key, Members...)
 	}
 
 	return nil
@@ -169,15 +237,24 @@ func (this *RedisClient) ZRem(key string, Members ...interface{}) *redis.IntCmd
 // ZRangeWithScore ...
 func (this *RedisClient) ZRangeWithScore(key string, start, stop int64) *redis.ZSliceCmd {
 
-	this.Lock.RLock()
-	defer this.Lock.RUnlock()
+	client, release := this.acquire()
+	defer release()
 
-	if this.Client != nil {
-		return this.Client.ZRangeWithScores(key, start, stop)
+	if client != nil {
+		return client.ZRangeWithScores(key, start, stop)
 	}
 
-	if this.ClusterClient != nil {
-		return this.ClusterClient.ZRangeWithScores(key, start, stop)
+	return nil
+}
+
+// XAdd append entry to stream
+func (this *RedisClient) XAdd(a *redis.XAddArgs) *redis.StringCmd {
+
+	client, release := this.acquire()
+	defer release()
+
+	if client != nil {
+		return client.XAdd(a)
 	}
 
 	return nil
@@ -186,16 +263,11 @@ func (this *RedisClient) ZRangeWithScore(key string, start, stop int64) *redis.Z
 // Ping connection test
 func (this *RedisClient) Ping() bool {
 
-	this.Lock.RLock()
-	defer this.Lock.RUnlock()
+	client, release := this.acquire()
+	defer release()
 
-	if this.Client != nil {
-		_, err := this.Client.Ping().Result()
-		return err == nil
-	}
-
-	if this.ClusterClient != nil {
-		_, err := this.ClusterClient.Ping().Result()
+	if client != nil {
+		_, err := client.Ping().Result()
 		return err == nil
 	}
 
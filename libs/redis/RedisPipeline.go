@@ -0,0 +1,112 @@
+package Redis
+
+import (
+	"math/rand"
+	"time"
+
+	Const "iparking/share/const"
+
+	"github.com/go-redis/redis"
+)
+
+const (
+	redisWatchMaxAttempts = 10
+	redisWatchBackoffBase = 2 * time.Millisecond
+	redisWatchBackoffMax  = 100 * time.Millisecond
+)
+
+// Pipeline batch queued commands into one round trip on Exec. In cluster mode commands are grouped by
+// the node serving their slot, one round trip per node. Like Cmdable it is not tracked across a
+// reconnect, prefer Pipelined
+func (this *RedisClient) Pipeline() redis.Pipeliner {
+
+	if client := this.Cmdable(); client != nil {
+		return client.Pipeline()
+	}
+
+	return nil
+}
+
+// Pipelined queue commands in fn and execute them in one batch
+func (this *RedisClient) Pipelined(fn func(pipe redis.Pipeliner) error) ([]redis.Cmder, error) {
+
+	client, release := this.acquire()
+	defer release()
+
+	if client == nil {
+		return nil, Const.ErrRedis_NotConnected
+	}
+
+	return client.Pipelined(fn)
+}
+
+// TxPipeline like Pipeline, wrapped in MULTI/EXEC. In cluster mode a transaction cannot span slots, so
+// commands are grouped by slot and every slot runs its own MULTI/EXEC
+func (this *RedisClient) TxPipeline() redis.Pipeliner {
+
+	if client := this.Cmdable(); client != nil {
+		return client.TxPipeline()
+	}
+
+	return nil
+}
+
+// TxPipelined queue commands in fn and execute them in MULTI/EXEC
+func (this *RedisClient) TxPipelined(fn func(pipe redis.Pipeliner) error) ([]redis.Cmder, error) {
+
+	client, release := this.acquire()
+	defer release()
+
+	if client == nil {
+		return nil, Const.ErrRedis_NotConnected
+	}
+
+	return client.TxPipelined(fn)
+}
+
+// Watch run fn as an optimistic transaction: keys are WATCHed, fn reads them through tx and writes with
+// tx.TxPipelined. When a watched key changes before EXEC, fn is run again, up to maxAttempts times
+// (default 10), then redis.TxFailedErr is returned. In cluster mode keys must share a slot
+func (this *RedisClient) Watch(maxAttempts int, fn func(tx *redis.Tx) error, keys ...string) error {
+
+	if maxAttempts <= 0 {
+		maxAttempts = redisWatchMaxAttempts
+	}
+
+	client, release := this.acquire()
+	defer release()
+
+	watch := func() error {
+		switch client := client.(type) {
+		case *redis.Client:
+			return client.Watch(fn, keys...)
+		case *redis.ClusterClient:
+			return client.Watch(fn, keys...)
+		}
+		return Const.ErrRedis_NotConnected
+	}
+
+	var err error
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+
+		if err = watch(); err != redis.TxFailedErr {
+			return err
+		}
+
+		if attempt < maxAttempts {
+			time.Sleep(watchBackoff(attempt))
+		}
+	}
+
+	return err
+}
+
+func watchBackoff(n int) time.Duration {
+
+	d := redisWatchBackoffBase << uint(n-1)
+	if d <= 0 || d > redisWatchBackoffMax {
+		d = redisWatchBackoffMax
+	}
+
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
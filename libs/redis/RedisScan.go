@@ -0,0 +1,59 @@
+package Redis
+
+import (
+	"sync"
+
+	Const "iparking/share/const"
+
+	"github.com/go-redis/redis"
+)
+
+// ScanAll call fn with every key matching match. In cluster mode every master is scanned, since SCAN
+// only walks the node it is sent to. fn is never called concurrently, returning an error stops the scan
+func (this *RedisClient) ScanAll(match string, count int64, fn func(key string) error) error {
+
+	client, release := this.acquire()
+	defer release()
+
+	if node, ok := client.(*redis.Client); ok {
+		return scanNode(node, match, count, fn)
+	}
+
+	cluster, ok := client.(*redis.ClusterClient)
+	if !ok {
+		return Const.ErrRedis_NotConnected
+	}
+
+	var lock sync.Mutex
+	return cluster.ForEachMaster(func(master *redis.Client) error {
+		return scanNode(master, match, count, func(key string) error {
+			lock.Lock()
+			defer lock.Unlock()
+			return fn(key)
+		})
+	})
+}
+
+// ScanKeys every key matching match, across all masters in cluster mode
+func (this *RedisClient) ScanKeys(match string, count int64) ([]string, error) {
+
+	keys := []string{}
+	err := this.ScanAll(match, count, func(key string) error {
+		keys = append(keys, key)
+		return nil
+	})
+
+	return keys, err
+}
+
+func scanNode(client *redis.Client, match string, count int64, fn func(key string) error) error {
+
+	iter := client.Scan(0, match, count).Iterator()
+	for iter.Next() {
+		if err := fn(iter.Val()); err != nil {
+			return err
+		}
+	}
+
+	return iter.Err()
+}